@@ -0,0 +1,339 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"trello-clone/internal/httputil"
+	"trello-clone/internal/mail"
+)
+
+const (
+	// reauthWindow is how recent a sign-in must be to stand in for the
+	// current password on sensitive account changes.
+	reauthWindow = 10 * time.Minute
+	// emailChangeTTL is how long the link sent to a new address stays valid.
+	emailChangeTTL = 24 * time.Hour
+	// accountDeletionGrace is how long a requested account deletion can
+	// still be cancelled.
+	accountDeletionGrace = 14 * 24 * time.Hour
+)
+
+// reauthenticate confirms the request comes from the account holder before
+// a sensitive change: currentPassword must be right or, failing that, the
+// session must have signed in within reauthWindow. Wrong passwords count
+// towards the login lockout. On failure it has written the response.
+func (h *Handler) reauthenticate(w http.ResponseWriter, r *http.Request, u *User, currentPassword string) bool {
+	if currentPassword != "" && u.PasswordHash != "" {
+		_, ip := clientInfo(r)
+		if !h.checkLoginLockout(w, r, ip, u.Email) {
+			return false
+		}
+		if CheckPassword(u.PasswordHash, currentPassword) {
+			return true
+		}
+		if err := h.recordLoginFailure(r.Context(), ip, u.Email); err != nil {
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+			return false
+		}
+		httputil.Error(w, http.StatusForbidden, "incorrect password")
+		return false
+	}
+	if sess := SessionFromContext(r.Context()); sess != nil && time.Since(sess.CreatedAt) < reauthWindow {
+		return true
+	}
+	if u.PasswordHash == "" {
+		httputil.Error(w, http.StatusForbidden, "sign in again to continue")
+	} else {
+		httputil.Error(w, http.StatusForbidden, "current password required")
+	}
+	return false
+}
+
+// ChangePassword sets a new password, or adds one to an account that only
+// signs in with OAuth. Every other session is signed out and this one gets
+// a new token.
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if len(req.NewPassword) < 8 {
+		httputil.Error(w, http.StatusBadRequest, "password must be at least 8 characters")
+		return
+	}
+	if !h.reauthenticate(w, r, u, req.CurrentPassword) {
+		return
+	}
+
+	hash, err := HashPassword(req.NewPassword)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	var keepID string
+	if sess := SessionFromContext(r.Context()); sess != nil {
+		keepID = sess.ID
+	}
+	if err := h.Store.SetPassword(r.Context(), u.ID, hash, keepID); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := h.rotateSession(w, r); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	msg := mail.Message{
+		To:      u.Email,
+		Subject: "Your FlowBoard password was changed",
+		Body: "The password for your FlowBoard account was just changed, and other devices were signed out.\n\n" +
+			"If that wasn't you, reset your password now:\n" + h.AppURL + "/forgot-password\n",
+	}
+	if u.PasswordHash == "" {
+		msg.Subject = "A password was added to your FlowBoard account"
+		msg.Body = "You can now sign in to FlowBoard with your email and password as well.\n\n" +
+			"If that wasn't you, reset your password now:\n" + h.AppURL + "/forgot-password\n"
+	}
+	h.notify(r.Context(), u, msg)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangeEmail starts changing the account's address. A link goes to the
+// new address and the old one is told about the request; the change takes
+// effect when the link is followed (ConfirmEmailChange).
+func (h *Handler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var req struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if !strings.Contains(req.Email, "@") || strings.ContainsAny(req.Email, " \r\n") {
+		httputil.Error(w, http.StatusBadRequest, "valid email required")
+		return
+	}
+	if req.Email == u.Email {
+		httputil.Error(w, http.StatusBadRequest, "that is already your email")
+		return
+	}
+	if !h.reauthenticate(w, r, u, req.CurrentPassword) {
+		return
+	}
+	if h.Mailer == nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to send email")
+		return
+	}
+
+	token, err := h.Store.CreateEmailChange(r.Context(), u.ID, req.Email, emailChangeTTL)
+	if errors.Is(err, ErrEmailTaken) {
+		httputil.Error(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	link := h.AppURL + "/confirm-email?token=" + url.QueryEscape(token)
+	if err := h.Mailer.Send(r.Context(), mail.Message{
+		To:      req.Email,
+		Subject: "Confirm your new FlowBoard email address",
+		Body: "Open this link within 24 hours to use this address for your FlowBoard account:\n" +
+			link + "\n\n" +
+			"If you didn't ask for this, you can ignore this email.\n",
+	}); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to send email")
+		return
+	}
+	h.notify(r.Context(), u, mail.Message{
+		To:      u.Email,
+		Subject: "Your FlowBoard email address is being changed",
+		Body: "Someone asked to change the email address of your FlowBoard account to " + req.Email + ".\n" +
+			"It changes once the link sent to that address is opened.\n\n" +
+			"If that wasn't you, reset your password now:\n" + h.AppURL + "/forgot-password\n",
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfirmEmailChange switches the account to the new address using the
+// token emailed there.
+func (h *Handler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if _, err := h.Store.ConfirmEmailChange(r.Context(), req.Token); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			httputil.Error(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrEmailTaken):
+			httputil.Error(w, http.StatusConflict, err.Error())
+		default:
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteAccount schedules the signed-in user's account for deletion once
+// accountDeletionGrace has passed. The request has to repeat the account's
+// email address and pass reauthenticate. JobDeleteAccounts does the actual
+// deletion; until then CancelAccountDeletion keeps the account.
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var req struct {
+		Confirm         string `json:"confirm"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(req.Confirm), u.Email) {
+		httputil.Error(w, http.StatusBadRequest, "confirm with your email address")
+		return
+	}
+	if !h.reauthenticate(w, r, u, req.CurrentPassword) {
+		return
+	}
+
+	at := time.Now().Add(accountDeletionGrace).Truncate(time.Second)
+	err := h.Store.ScheduleAccountDeletion(r.Context(), u.ID, at)
+	if errors.Is(err, ErrDeletionScheduled) {
+		httputil.Error(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	h.notify(r.Context(), u, mail.Message{
+		To:      u.Email,
+		Subject: "Your FlowBoard account will be deleted",
+		Body: "As requested, your FlowBoard account and all of its boards will be deleted on " +
+			at.UTC().Format("2 January 2006 at 15:04 MST") + ".\n\n" +
+			"To keep your account, sign in before then and cancel the deletion:\n" + h.AppURL + "/login\n",
+	})
+	httputil.JSON(w, http.StatusAccepted, map[string]time.Time{"deletion_scheduled_at": at})
+}
+
+// CancelAccountDeletion keeps an account that is waiting to be deleted.
+func (h *Handler) CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	err := h.Store.CancelAccountDeletion(r.Context(), u.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		httputil.Error(w, http.StatusNotFound, "no deletion scheduled")
+		return
+	}
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JobDeleteAccounts is the job kind that runs DeleteDueAccounts.
+const JobDeleteAccounts = "auth.delete_accounts"
+
+// DeleteDueAccounts deletes the accounts whose grace period is over, each
+// in its own transaction, and tells their former owners — scheduled as
+// JobDeleteAccounts. Every deletion is recorded in account_deletions and
+// logged.
+func (h *Handler) DeleteDueAccounts(ctx context.Context) error {
+	ids, err := h.Store.DueAccountDeletions(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range ids {
+		email, boards, err := h.Store.DeleteAccount(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue // cancelled since it was listed
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("delete account %s: %w", id, err))
+			continue
+		}
+		slog.InfoContext(ctx, "deleted account", "user_id", id, "boards", boards)
+		h.notify(ctx, &User{ID: id}, mail.Message{
+			To:      email,
+			Subject: "Your FlowBoard account has been deleted",
+			Body:    "Your FlowBoard account and all of its boards have been deleted, as you requested.\n",
+		})
+	}
+	return errors.Join(errs...)
+}
+
+// ExportAccount sends a ZIP archive of everything stored about the
+// signed-in user, one JSON file per table (see Store.ExportAccount).
+func (h *Handler) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	files, err := h.Store.ExportAccount(r.Context(), u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="flowboard-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	now := time.Now()
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, f.Data, "", "  "); err != nil {
+			break
+		}
+		buf.WriteByte('\n')
+		var fw io.Writer
+		fw, err = zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			break
+		}
+		if _, err = fw.Write(buf.Bytes()); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	// Headers are already sent at this point, so all we can do is log.
+	if err != nil {
+		slog.ErrorContext(r.Context(), "export account", "error", err)
+	}
+}
+
+// notify sends a security notice. The change it reports has already
+// happened, so a failure is only logged.
+func (h *Handler) notify(ctx context.Context, u *User, msg mail.Message) {
+	if h.Mailer == nil {
+		return
+	}
+	if err := h.Mailer.Send(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "notify user", "user_id", u.ID, "error", err)
+	}
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"trello-clone/internal/mail"
+	"trello-clone/internal/testutil"
+)
+
+// accountRequest calls handler as u signed in with sess.
+func accountRequest(t *testing.T, handler http.HandlerFunc, u *User, sess *Session, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	ctx := context.WithValue(r.Context(), userKey, u)
+	if sess != nil {
+		ctx = context.WithValue(ctx, sessionKey, sess)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r.WithContext(ctx))
+	return w
+}
+
+func TestReauthenticateNeedsRecentLogin(t *testing.T) {
+	h := &Handler{}
+	oauthOnly := &User{ID: "u1", Email: "oauth@example.com"}
+
+	old := &Session{CreatedAt: time.Now().Add(-time.Hour)}
+	w := accountRequest(t, h.ChangePassword, oauthOnly, old, `{"new_password":"newpassword"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("old session: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	w = accountRequest(t, h.ChangePassword, oauthOnly, nil, `{"new_password":"newpassword"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("token auth: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	mailer := &mail.Memory{}
+	h := &Handler{Store: store, Mailer: mailer, AppURL: "http://app.test"}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "change@example.com")
+	current, _ := store.CreateSession(ctx, u.ID, "laptop", "127.0.0.1")
+	other, _ := store.CreateSession(ctx, u.ID, "phone", "127.0.0.1")
+	oldToken := current.Token
+	// Signed in long ago, so the current password is needed.
+	current.CreatedAt = time.Now().Add(-time.Hour)
+
+	w := accountRequest(t, h.ChangePassword, u, current, `{"new_password":"newpassword"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("no current password: status = %d", w.Code)
+	}
+	w = accountRequest(t, h.ChangePassword, u, current, `{"current_password":"wrong-password","new_password":"newpassword"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("wrong password: status = %d", w.Code)
+	}
+	w = accountRequest(t, h.ChangePassword, u, current, `{"current_password":"password123","new_password":"short"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("short password: status = %d", w.Code)
+	}
+
+	w = accountRequest(t, h.ChangePassword, u, current, `{"current_password":"password123","new_password":"newpassword"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("change: status = %d; body = %s", w.Code, w.Body.String())
+	}
+
+	updated, _ := store.UserByID(ctx, u.ID)
+	if !CheckPassword(updated.PasswordHash, "newpassword") {
+		t.Fatal("password not changed")
+	}
+	if _, err := store.SessionByToken(ctx, other.Token); err == nil {
+		t.Fatal("other sessions should be signed out")
+	}
+	if _, err := store.SessionByToken(ctx, oldToken); err == nil {
+		t.Fatal("current session should get a new token")
+	}
+	if _, err := store.SessionByToken(ctx, current.Token); err != nil {
+		t.Fatalf("current session after rotation: %v", err)
+	}
+
+	msgs := mailer.Messages()
+	if len(msgs) != 1 || msgs[0].To != "change@example.com" || !strings.Contains(msgs[0].Subject, "password was changed") {
+		t.Fatalf("messages = %+v", msgs)
+	}
+}
+
+func TestSetPasswordForOAuthUser(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store, Mailer: &mail.Memory{}}
+	ctx := context.Background()
+
+	u, _ := store.FindOrCreateOAuthUser(ctx, "google", "g-set", "oauthset@example.com", "OAuth", true)
+	sess, _ := store.CreateSession(ctx, u.ID, "laptop", "127.0.0.1")
+
+	w := accountRequest(t, h.ChangePassword, u, sess, `{"new_password":"firstpassword"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d; body = %s", w.Code, w.Body.String())
+	}
+	lw := jsonRequest(t, h.Login, "/api/auth/login", `{"email":"oauthset@example.com","password":"firstpassword"}`)
+	if lw.Code != http.StatusOK {
+		t.Fatalf("login with new password: status = %d", lw.Code)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	mailer := &mail.Memory{}
+	h := &Handler{Store: store, Mailer: mailer, AppURL: "http://app.test"}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "before@example.com")
+	createTestUser(t, db, "taken@example.com")
+	sess, _ := store.CreateSession(ctx, u.ID, "laptop", "127.0.0.1")
+
+	w := accountRequest(t, h.ChangeEmail, u, sess, `{"email":"taken@example.com"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("taken: status = %d", w.Code)
+	}
+	w = accountRequest(t, h.ChangeEmail, u, sess, `{"email":"after@example.com"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("change: status = %d; body = %s", w.Code, w.Body.String())
+	}
+
+	// Nothing changes until the new address is confirmed.
+	if cur, _ := store.UserByID(ctx, u.ID); cur.Email != "before@example.com" {
+		t.Fatalf("email = %s before confirmation", cur.Email)
+	}
+
+	msgs := mailer.Messages()
+	if len(msgs) != 2 || msgs[0].To != "after@example.com" || msgs[1].To != "before@example.com" {
+		t.Fatalf("messages = %+v", msgs)
+	}
+	_, link, _ := strings.Cut(msgs[0].Body, "http://app.test/confirm-email?token=")
+	token, _, _ := strings.Cut(link, "\n")
+
+	w = jsonRequest(t, h.ConfirmEmailChange, "/api/auth/email/change/confirm", `{"token":"`+token+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("confirm: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	cur, _ := store.UserByID(ctx, u.ID)
+	if cur.Email != "after@example.com" || cur.EmailVerifiedAt == nil {
+		t.Fatalf("user = %+v", cur)
+	}
+
+	w = jsonRequest(t, h.ConfirmEmailChange, "/api/auth/email/change/confirm", `{"token":"`+token+`"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reuse: status = %d", w.Code)
+	}
+}
+
+func TestDeleteAccountNeedsConfirmation(t *testing.T) {
+	h := &Handler{}
+	u := &User{ID: "u1", Email: "me@example.com"}
+	sess := &Session{CreatedAt: time.Now()}
+
+	w := accountRequest(t, h.DeleteAccount, u, sess, `{"confirm":"someone@example.com"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	mailer := &mail.Memory{}
+	h := &Handler{Store: store, Mailer: mailer, AppURL: "http://app.test"}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "leaving@example.com")
+	sess, _ := store.CreateSession(ctx, u.ID, "laptop", "127.0.0.1")
+	if _, err := db.Exec(`INSERT INTO boards (user_id, name) VALUES ($1, 'Mine')`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"confirm":"Leaving@example.com"}`
+	if w := accountRequest(t, h.DeleteAccount, u, sess, body); w.Code != http.StatusAccepted {
+		t.Fatalf("schedule: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	if w := accountRequest(t, h.DeleteAccount, u, sess, body); w.Code != http.StatusConflict {
+		t.Fatalf("schedule twice: status = %d", w.Code)
+	}
+	if w := accountRequest(t, h.CancelAccountDeletion, u, sess, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("cancel: status = %d", w.Code)
+	}
+	if w := accountRequest(t, h.CancelAccountDeletion, u, sess, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("cancel twice: status = %d", w.Code)
+	}
+	if w := accountRequest(t, h.DeleteAccount, u, sess, body); w.Code != http.StatusAccepted {
+		t.Fatalf("schedule again: status = %d", w.Code)
+	}
+
+	// Nothing happens during the grace period.
+	if err := h.DeleteDueAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := store.UserByID(ctx, u.ID); err != nil || cur.DeletionScheduledAt == nil {
+		t.Fatalf("user = %+v, err = %v", cur, err)
+	}
+
+	db.Exec(`UPDATE users SET deletion_scheduled_at = now() - interval '1 minute' WHERE id=$1`, u.ID)
+	if err := h.DeleteDueAccounts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UserByID(ctx, u.ID); err == nil {
+		t.Fatal("user not deleted")
+	}
+	var boards, sessions int
+	db.QueryRow(`SELECT count(*) FROM boards WHERE user_id=$1`, u.ID).Scan(&boards)
+	db.QueryRow(`SELECT count(*) FROM sessions WHERE user_id=$1`, u.ID).Scan(&sessions)
+	if boards != 0 || sessions != 0 {
+		t.Fatalf("boards = %d, sessions = %d after deletion", boards, sessions)
+	}
+
+	var cancelled, completed, boardsDeleted int
+	db.QueryRow(`SELECT count(cancelled_at), count(completed_at), COALESCE(sum(boards_deleted), 0)
+		FROM account_deletions WHERE user_id=$1`, u.ID).Scan(&cancelled, &completed, &boardsDeleted)
+	if cancelled != 1 || completed != 1 || boardsDeleted != 1 {
+		t.Fatalf("audit: cancelled = %d, completed = %d, boards = %d", cancelled, completed, boardsDeleted)
+	}
+
+	msgs := mailer.Messages()
+	last := msgs[len(msgs)-1]
+	if len(msgs) != 3 || last.To != "leaving@example.com" || !strings.Contains(last.Subject, "has been deleted") {
+		t.Fatalf("messages = %+v", msgs)
+	}
+}
+
+func TestExportAccount(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "export@example.com")
+	other := createTestUser(t, db, "other@example.com")
+	sess, _ := store.CreateSession(ctx, u.ID, "laptop", "127.0.0.1")
+	db.Exec(`INSERT INTO boards (user_id, name) VALUES ($1, 'Mine'), ($2, 'Theirs')`, u.ID, other.ID)
+	db.Exec(`INSERT INTO jobs (kind, payload, max_attempts) VALUES
+		('mail.send', '{"to":"export@example.com","subject":"Hi","body":"link: s3cret"}', 5),
+		('mail.send', '{"to":"other@example.com","subject":"Hi","body":"not yours"}', 5)`)
+
+	w := accountRequest(t, h.ExportAccount, u, sess, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, content type = %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]map[string]any{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		var rows []map[string]any
+		if err := json.Unmarshal(data, &rows); err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		files[f.Name] = rows
+	}
+
+	account := files["account.json"]
+	if len(account) != 1 || account[0]["email"] != "export@example.com" {
+		t.Fatalf("account.json = %v", account)
+	}
+	if _, ok := account[0]["password_hash"]; ok {
+		t.Fatal("password hash exported")
+	}
+	if s := files["sessions.json"]; len(s) != 1 || s[0]["token_hash"] != nil {
+		t.Fatalf("sessions.json = %v", s)
+	}
+	if b := files["boards.json"]; len(b) != 1 || b[0]["name"] != "Mine" {
+		t.Fatalf("boards.json = %v", b)
+	}
+	if _, ok := files["webhook_delivery_attempts.json"]; !ok {
+		t.Fatal("missing webhook_delivery_attempts.json")
+	}
+	// Queued mail is listed by recipient and subject, without its body.
+	jobs := files["jobs.json"]
+	if len(jobs) != 1 || jobs[0]["mail_to"] != "export@example.com" || jobs[0]["mail_subject"] != "Hi" {
+		t.Fatalf("jobs.json = %v", jobs)
+	}
+	if _, ok := jobs[0]["payload"]; ok {
+		t.Fatal("mail body exported")
+	}
+}
@@ -1,26 +1,47 @@
 package auth
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
 	"time"
 	"trello-clone/internal/httputil"
+	"trello-clone/internal/jobs"
+	"trello-clone/internal/mail"
 )
 
 type Handler struct {
 	Store        *Store
 	CookieDomain string
+	Mailer       mail.Mailer
+	// AppURL is the frontend origin, used for links in emails.
+	AppURL string
+	// Jobs, if set, runs password reset requests as JobPasswordReset, so
+	// the response takes as long whether or not the account exists.
+	Jobs *jobs.Queue
 }
 
-func (h *Handler) setSessionCookie(w http.ResponseWriter, token string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    token,
-		Path:     "/",
-		Domain:   h.CookieDomain,
-		MaxAge:   30 * 24 * 60 * 60,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+// startSession signs the user in on this device and sets the cookie.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, userID string) error {
+	return startSession(w, r, h.Store, h.CookieDomain, userID)
+}
+
+// rotateSession gives the current session a new token after a privilege
+// change. Requests authenticated by an access token have no session.
+func (h *Handler) rotateSession(w http.ResponseWriter, r *http.Request) error {
+	sess := SessionFromContext(r.Context())
+	if sess == nil {
+		return nil
+	}
+	if err := h.Store.RotateSession(r.Context(), sess); err != nil {
+		return err
+	}
+	setSessionCookie(w, h.CookieDomain, sess)
+	return nil
 }
 
 func (h *Handler) clearSessionCookie(w http.ResponseWriter) {
@@ -42,7 +63,7 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		Name     string `json:"name"`
 	}
 	if err := httputil.Decode(r, &req); err != nil {
-		httputil.Error(w, http.StatusBadRequest, "invalid request body")
+		httputil.InvalidBody(w, err)
 		return
 	}
 	if req.Email == "" || req.Password == "" {
@@ -71,13 +92,15 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess, err := h.Store.CreateSession(r.Context(), u.ID)
-	if err != nil {
+	if err := h.startSession(w, r, u.ID); err != nil {
 		httputil.Error(w, http.StatusInternalServerError, "internal error")
 		return
 	}
 
-	h.setSessionCookie(w, sess.Token)
+	if err := h.sendEmailVerification(r.Context(), u); err != nil {
+		slog.ErrorContext(r.Context(), "send email verification", "user_id", u.ID, "error", err)
+	}
+
 	httputil.JSON(w, http.StatusCreated, u)
 }
 
@@ -87,27 +110,50 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		Password string `json:"password"`
 	}
 	if err := httputil.Decode(r, &req); err != nil {
-		httputil.Error(w, http.StatusBadRequest, "invalid request body")
+		httputil.InvalidBody(w, err)
+		return
+	}
+
+	_, ip := clientInfo(r)
+	if !h.checkLoginLockout(w, r, ip, req.Email) {
 		return
 	}
 
 	u, err := h.Store.UserByEmail(r.Context(), req.Email)
-	if err != nil {
-		httputil.Error(w, http.StatusUnauthorized, "invalid credentials")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	if !CheckPassword(u.PasswordHash, req.Password) {
+	ok := false
+	if u != nil && u.PasswordHash != "" {
+		ok = CheckPassword(u.PasswordHash, req.Password)
+	} else {
+		// Unknown email or OAuth-only account: spend the same time anyway.
+		CheckDummyPassword(req.Password)
+	}
+	if !ok {
+		if err := h.recordLoginFailure(r.Context(), ip, req.Email); err != nil {
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
 		httputil.Error(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
-
-	sess, err := h.Store.CreateSession(r.Context(), u.ID)
-	if err != nil {
+	// The account's failures are only forgiven once the whole login
+	// succeeds; LoginTwoFactor clears them after the second factor.
+	if u.TwoFactorEnabled {
+		h.writeLoginChallenge(w, r, u)
+		return
+	}
+	if err := h.Store.ClearLoginFailures(r.Context(), LoginScopeAccount, accountSubject(req.Email)); err != nil {
 		httputil.Error(w, http.StatusInternalServerError, "internal error")
 		return
 	}
 
-	h.setSessionCookie(w, sess.Token)
+	if err := h.startSession(w, r, u.ID); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
 	httputil.JSON(w, http.StatusOK, u)
 }
 
@@ -129,7 +175,312 @@ func (h *Handler) Me(w http.ResponseWriter, r *http.Request) {
 	httputil.JSON(w, http.StatusOK, u)
 }
 
-// cleanup deletes expired sessions — called periodically
-func (h *Handler) CleanupSessions() {
-	h.Store.DB.Exec("DELETE FROM sessions WHERE expires_at < $1", time.Now())
+// errNoMailer is returned when email is needed but no Mailer is set.
+var errNoMailer = errors.New("no mailer configured")
+
+// Password reset
+
+// passwordResetTTL is how long an emailed reset link stays valid.
+const passwordResetTTL = time.Hour
+
+// RequestPasswordReset emails a reset link to the address if it belongs to
+// an account. The response is the same either way, so it can't be used to
+// find out which emails are registered. Requests are rate limited per
+// client and per address.
+func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.Email == "" {
+		httputil.Error(w, http.StatusBadRequest, "email required")
+		return
+	}
+
+	_, ip := clientInfo(r)
+	if !h.checkResetLockout(w, r, ip, req.Email) {
+		return
+	}
+	if err := h.recordResetRequest(r.Context(), ip, req.Email); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	if h.Jobs != nil {
+		if _, err := h.Jobs.Enqueue(r.Context(), JobPasswordReset, req.Email); err != nil {
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+	} else if err := h.SendPasswordReset(r.Context(), req.Email); err != nil {
+		slog.ErrorContext(r.Context(), "send password reset", "error", err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// JobPasswordReset is the job kind that runs SendPasswordReset. Its payload
+// is the requested email address.
+const JobPasswordReset = "auth.password_reset"
+
+// SendPasswordReset emails a reset link to email if an account has it, and
+// does nothing otherwise.
+func (h *Handler) SendPasswordReset(ctx context.Context, email string) error {
+	u, err := h.Store.UserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return h.sendPasswordReset(ctx, u)
+}
+
+func (h *Handler) sendPasswordReset(ctx context.Context, u *User) error {
+	if h.Mailer == nil {
+		return errNoMailer
+	}
+	token, err := h.Store.CreatePasswordResetToken(ctx, u.ID, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	link := h.AppURL + "/reset-password?token=" + url.QueryEscape(token)
+	return h.Mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Reset your FlowBoard password",
+		Body: "Someone asked to reset the password for your FlowBoard account.\n\n" +
+			"Open this link within an hour to choose a new password:\n" + link + "\n\n" +
+			"If that wasn't you, you can ignore this email; your password stays the same.\n",
+	})
+}
+
+// ResetPassword sets a new password using an emailed reset token and signs
+// the user out everywhere.
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.Token == "" {
+		httputil.Error(w, http.StatusBadRequest, "token required")
+		return
+	}
+	if len(req.Password) < 8 {
+		httputil.Error(w, http.StatusBadRequest, "password must be at least 8 characters")
+		return
+	}
+
+	hash, err := HashPassword(req.Password)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if _, err := h.Store.ResetPassword(r.Context(), req.Token, hash); err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			httputil.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	h.clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sessions
+
+// ListSessions returns the user's signed-in devices. The one making the
+// request is marked current.
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	sessions, err := h.Store.ListSessions(r.Context(), u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+
+	type sessionJSON struct {
+		Session
+		Current bool `json:"current"`
+	}
+	var currentID string
+	if cur := SessionFromContext(r.Context()); cur != nil {
+		currentID = cur.ID
+	}
+	resp := make([]sessionJSON, len(sessions))
+	for i, sess := range sessions {
+		resp[i] = sessionJSON{sess, sess.ID == currentID}
+	}
+	httputil.JSON(w, http.StatusOK, resp)
+}
+
+// RevokeSession signs out one of the user's devices.
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	id := r.PathValue("id")
+	if err := h.Store.RevokeSession(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if cur := SessionFromContext(r.Context()); cur != nil && cur.ID == id {
+		h.clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessions signs out every device except the one making the
+// request.
+func (h *Handler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var keepID string
+	if cur := SessionFromContext(r.Context()); cur != nil {
+		keepID = cur.ID
+	}
+	n, err := h.Store.RevokeOtherSessions(r.Context(), u.ID, keepID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to revoke sessions")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, map[string]int64{"revoked": n})
+}
+
+// Email verification
+
+// emailVerificationTTL is how long an emailed verification link stays valid.
+const emailVerificationTTL = 48 * time.Hour
+
+func (h *Handler) sendEmailVerification(ctx context.Context, u *User) error {
+	if h.Mailer == nil {
+		return errNoMailer
+	}
+	token, err := h.Store.CreateEmailVerificationToken(ctx, u.ID, u.Email, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	link := h.AppURL + "/verify-email?token=" + url.QueryEscape(token)
+	return h.Mailer.Send(ctx, mail.Message{
+		To:      u.Email,
+		Subject: "Verify your FlowBoard email address",
+		Body: "Please confirm that this is your email address by opening this link within 48 hours:\n" +
+			link + "\n\n" +
+			"If you didn't create a FlowBoard account, you can ignore this email.\n",
+	})
+}
+
+// VerifyEmail marks the address verified using an emailed token.
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if _, err := h.Store.VerifyEmail(r.Context(), req.Token); err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			httputil.Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResendEmailVerification sends a new verification link to the current
+// user's address.
+func (h *Handler) ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	if u.EmailVerifiedAt != nil {
+		httputil.Error(w, http.StatusConflict, "email already verified")
+		return
+	}
+	if err := h.sendEmailVerification(r.Context(), u); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to send email")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Personal access tokens
+
+func (h *Handler) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.Name == "" {
+		httputil.Error(w, http.StatusBadRequest, "name required")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{ScopeBoardsRead}
+	}
+	for _, sc := range req.Scopes {
+		if !slices.Contains(validScopes, sc) {
+			httputil.Error(w, http.StatusBadRequest, "unknown scope "+sc)
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		httputil.Error(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	token, t, err := h.Store.CreateAccessToken(r.Context(), u.ID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to create token")
+		return
+	}
+	// The plaintext token is only ever shown in this response.
+	httputil.JSON(w, http.StatusCreated, struct {
+		*AccessToken
+		Token string `json:"token"`
+	}{t, token})
+}
+
+func (h *Handler) ListAccessTokens(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	tokens, err := h.Store.ListAccessTokens(r.Context(), u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to list tokens")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, tokens)
+}
+
+func (h *Handler) DeleteAccessToken(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	if err := h.Store.DeleteAccessToken(r.Context(), r.PathValue("id"), u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JobCleanupSessions is the job kind that runs CleanupSessions.
+const JobCleanupSessions = "auth.cleanup_sessions"
+
+// CleanupSessions deletes expired sessions and login failures too old to
+// count — scheduled as JobCleanupSessions
+func (h *Handler) CleanupSessions(ctx context.Context) error {
+	if _, err := h.Store.DB.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := h.Store.DB.ExecContext(ctx,
+		"DELETE FROM login_failures WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < now())",
+		time.Now().Add(-loginFailureWindow))
+	return err
 }
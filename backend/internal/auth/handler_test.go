@@ -1,12 +1,15 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"trello-clone/internal/mail"
 	"trello-clone/internal/testutil"
 )
 
@@ -212,3 +215,308 @@ func TestMe(t *testing.T) {
 		t.Fatalf("email = %v, want me@example.com", user["email"])
 	}
 }
+
+func TestCreateAccessTokenValidation(t *testing.T) {
+	db := testutil.SetupDB(t)
+	h := &Handler{Store: &Store{DB: db}}
+	u := createTestUser(t, db, "patval@example.com")
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"missing name", `{"scopes":["boards:read"]}`, http.StatusBadRequest},
+		{"unknown scope", `{"name":"x","scopes":["admin"]}`, http.StatusBadRequest},
+		{"past expiry", `{"name":"x","expires_at":"2000-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{"valid", `{"name":"x","scopes":["boards:write"]}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/auth/tokens", strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+			w := httptest.NewRecorder()
+			h.CreateAccessToken(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d; body = %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func jsonRequest(t *testing.T, handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestPasswordReset(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	mailer := &mail.Memory{}
+	h := &Handler{Store: store, Mailer: mailer, AppURL: "http://app.test"}
+
+	sw := signupRequest(t, h.Signup, `{"email":"forgot@example.com","password":"password123"}`)
+	var oldSession string
+	for _, c := range sw.Result().Cookies() {
+		if c.Name == "session" {
+			oldSession = c.Value
+		}
+	}
+
+	// Known and unknown emails get the same response; only one gets mail.
+	for _, email := range []string{"forgot@example.com", "nobody@example.com"} {
+		w := jsonRequest(t, h.RequestPasswordReset, "/api/auth/password/forgot", `{"email":"`+email+`"}`)
+		if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+			t.Fatalf("%s: status = %d, body = %q", email, w.Code, w.Body.String())
+		}
+	}
+	msgs := mailer.Messages()
+	if len(msgs) != 1 || msgs[0].To != "forgot@example.com" {
+		t.Fatalf("messages = %+v", msgs)
+	}
+
+	_, link, _ := strings.Cut(msgs[0].Body, "http://app.test/reset-password?token=")
+	token, _, _ := strings.Cut(link, "\n")
+	if token == "" {
+		t.Fatalf("no reset link in %q", msgs[0].Body)
+	}
+
+	w := jsonRequest(t, h.ResetPassword, "/api/auth/password/reset", `{"token":"`+token+`","password":"short"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("short password: status = %d", w.Code)
+	}
+
+	w = jsonRequest(t, h.ResetPassword, "/api/auth/password/reset", `{"token":"`+token+`","password":"newpassword"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("reset: status = %d; body = %s", w.Code, w.Body.String())
+	}
+
+	// Single use.
+	w = jsonRequest(t, h.ResetPassword, "/api/auth/password/reset", `{"token":"`+token+`","password":"otherpassword"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("reuse: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if _, err := store.SessionByToken(context.Background(), oldSession); err == nil {
+		t.Fatal("existing session should be revoked")
+	}
+	w = jsonRequest(t, h.Login, "/api/auth/login", `{"email":"forgot@example.com","password":"newpassword"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login with new password: status = %d", w.Code)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	u := createTestUser(t, db, "expired@example.com")
+
+	token, err := store.CreatePasswordResetToken(context.Background(), u.ID, -time.Minute)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	w := jsonRequest(t, h.ResetPassword, "/api/auth/password/reset", `{"token":"`+token+`","password":"newpassword"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPasswordResetRateLimit(t *testing.T) {
+	db := testutil.SetupDB(t)
+	mailer := &mail.Memory{}
+	h := &Handler{Store: &Store{DB: db}, Mailer: mailer, AppURL: "http://app.test"}
+	createTestUser(t, db, "flooded@example.com")
+
+	// Every request counts, and the one that goes over the limit is still
+	// served; the next is refused.
+	for i := range resetAccountLimit.Free + 2 {
+		w := jsonRequest(t, h.RequestPasswordReset, "/api/auth/password/forgot", `{"email":"flooded@example.com"}`)
+		want := http.StatusAccepted
+		if i > resetAccountLimit.Free {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, want)
+		}
+	}
+	if n := len(mailer.Messages()); n != resetAccountLimit.Free+1 {
+		t.Fatalf("sent %d messages, want %d", n, resetAccountLimit.Free+1)
+	}
+
+	// Addresses without an account are limited the same way.
+	for range resetAccountLimit.Free + 1 {
+		jsonRequest(t, h.RequestPasswordReset, "/api/auth/password/forgot", `{"email":"ghost@example.com"}`)
+	}
+	w := jsonRequest(t, h.RequestPasswordReset, "/api/auth/password/forgot", `{"email":"ghost@example.com"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("unknown address: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// Reset requests don't lock out logins.
+	w = jsonRequest(t, h.Login, "/api/auth/login", `{"email":"flooded@example.com","password":"password123"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login after reset requests: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	mailer := &mail.Memory{}
+	h := &Handler{Store: store, Mailer: mailer, AppURL: "http://app.test"}
+
+	sw := signupRequest(t, h.Signup, `{"email":"verify@example.com","password":"password123"}`)
+	var user User
+	json.Unmarshal(sw.Body.Bytes(), &user)
+	if user.EmailVerifiedAt != nil {
+		t.Fatal("new signup should be unverified")
+	}
+
+	msgs := mailer.Messages()
+	if len(msgs) != 1 || msgs[0].To != "verify@example.com" {
+		t.Fatalf("messages = %+v", msgs)
+	}
+	_, link, _ := strings.Cut(msgs[0].Body, "http://app.test/verify-email?token=")
+	token, _, _ := strings.Cut(link, "\n")
+
+	w := jsonRequest(t, h.VerifyEmail, "/api/auth/email/verify", `{"token":"bogus"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("bogus token: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = jsonRequest(t, h.VerifyEmail, "/api/auth/email/verify", `{"token":"`+token+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("verify: status = %d; body = %s", w.Code, w.Body.String())
+	}
+
+	u, _ := store.UserByID(context.Background(), user.ID)
+	if u.EmailVerifiedAt == nil {
+		t.Fatal("email should be verified")
+	}
+
+	// Resending to a verified address is refused.
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/email/verify/resend", nil)
+	r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+	w = httptest.NewRecorder()
+	h.ResendEmailVerification(w, r)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("resend: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestListSessionsMarksCurrent(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "current@example.com")
+	store.CreateSession(ctx, u.ID, "phone", "10.0.0.2")
+	current, _ := store.CreateSession(ctx, u.ID, "laptop", "10.0.0.1")
+
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/sessions", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: current.Token})
+	w := httptest.NewRecorder()
+	RequireAuth(store)(http.HandlerFunc(h.ListSessions)).ServeHTTP(w, r)
+
+	var sessions []map[string]any
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("sessions = %d, want 2; body = %s", len(sessions), w.Body.String())
+	}
+	for _, sess := range sessions {
+		if want := sess["id"] == current.ID; sess["current"] != want {
+			t.Fatalf("session %v current = %v, want %v", sess["user_agent"], sess["current"], want)
+		}
+		if _, ok := sess["token"]; ok {
+			t.Fatal("token must not be listed")
+		}
+	}
+}
+
+func TestLoginReplacesExistingSession(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "fixation@example.com")
+	planted, _ := store.CreateSession(ctx, u.ID, "attacker", "10.6.6.6")
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login",
+		strings.NewReader(`{"email":"fixation@example.com","password":"password123"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(&http.Cookie{Name: "session", Value: planted.Token})
+	w := httptest.NewRecorder()
+	h.Login(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; body = %s", w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session" && c.Value == planted.Token {
+			t.Fatal("login must issue a new token")
+		}
+	}
+	if _, err := store.SessionByToken(ctx, planted.Token); err == nil {
+		t.Fatal("the session the request came with should be ended")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "locked@example.com")
+	login := func(password string) *httptest.ResponseRecorder {
+		return jsonRequest(t, h.Login, "/api/auth/login",
+			`{"email":"locked@example.com","password":"`+password+`"}`)
+	}
+
+	// The free attempts, then the failure that triggers the lockout.
+	for i := range accountLoginLimit.Free + 1 {
+		if w := login("wrong-password"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d", i+1, w.Code)
+		}
+	}
+
+	// Locked now, even with the right password.
+	w := login("password123")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if ra := w.Header().Get("Retry-After"); ra == "" || ra == "0" {
+		t.Fatalf("Retry-After = %q", ra)
+	}
+
+	// A password reset lifts the lockout.
+	token, _ := store.CreatePasswordResetToken(ctx, u.ID, time.Hour)
+	if _, err := store.ResetPassword(ctx, token, u.PasswordHash); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if w := login("password123"); w.Code != http.StatusOK {
+		t.Fatalf("after reset: status = %d; body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoginLockoutUnknownEmail(t *testing.T) {
+	db := testutil.SetupDB(t)
+	h := &Handler{Store: &Store{DB: db}}
+
+	// Unknown accounts lock out like real ones, so lockouts don't reveal
+	// which emails are registered.
+	var w *httptest.ResponseRecorder
+	for range accountLoginLimit.Free + 2 {
+		w = jsonRequest(t, h.Login, "/api/auth/login", `{"email":"ghost@example.com","password":"whatever1"}`)
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"trello-clone/internal/httputil"
+)
+
+// ListIdentities returns the provider accounts linked to the user.
+func (h *OAuthHandler) ListIdentities(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	identities, err := h.Store.ListOAuthIdentities(r.Context(), u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to list identities")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, identities)
+}
+
+// StartLink begins linking another provider account to the signed-in user.
+// It answers with the provider's authorization URL for the frontend to
+// navigate to; the provider then returns to the usual callback.
+func (h *OAuthHandler) StartLink(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	authURL, status, err := h.beginFlow(w, r, u.ID)
+	if err != nil {
+		httputil.Error(w, status, err.Error())
+		return
+	}
+	httputil.JSON(w, http.StatusOK, map[string]string{"url": authURL})
+}
+
+// finishLink completes a link started by StartLink. The browser must still
+// be signed in as the user who started it.
+func (h *OAuthHandler) finishLink(w http.ResponseWriter, r *http.Request, userID, provider string, info *userInfo, redirectTo string) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		http.Error(w, "sign in to link an account", http.StatusUnauthorized)
+		return
+	}
+	sess, err := h.Store.SessionByToken(r.Context(), cookie.Value)
+	if err != nil || sess.UserID != userID {
+		http.Error(w, "sign in to link an account", http.StatusUnauthorized)
+		return
+	}
+
+	err = h.Store.LinkOAuthIdentity(r.Context(), userID, provider, info.ID, info.Email)
+	if errors.Is(err, ErrIdentityLinked) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to link account", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, redirectTo, http.StatusTemporaryRedirect)
+}
+
+// UnlinkIdentity removes a linked provider account. The last one can't be
+// removed from an account without a password.
+func (h *OAuthHandler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	err := h.Store.UnlinkOAuthIdentity(r.Context(), u.ID, r.PathValue("id"))
+	if errors.Is(err, ErrLastLoginMethod) {
+		httputil.Error(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		httputil.Error(w, http.StatusNotFound, "identity not found")
+		return
+	}
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to unlink identity")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"trello-clone/internal/testutil"
+)
+
+// startLink calls StartLink as u and returns the callback request the
+// browser makes once the provider approves, carrying sessionToken.
+func startLink(t *testing.T, h *OAuthHandler, s *stubOIDC, u *User, sessionToken string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/oauth/keycloak/link", nil)
+	r.SetPathValue("provider", "keycloak")
+	r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+	w := httptest.NewRecorder()
+	h.StartLink(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("start link: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	loc, _ := url.Parse(resp["url"])
+	q := loc.Query()
+	s.challenge = q.Get("code_challenge")
+	s.nonce = q.Get("nonce")
+
+	cb := httptest.NewRequest(http.MethodGet,
+		"/api/auth/oauth/keycloak/callback?code=good-code&state="+url.QueryEscape(q.Get("state")), nil)
+	cb.SetPathValue("provider", "keycloak")
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			cb.AddCookie(c)
+		}
+	}
+	if sessionToken != "" {
+		cb.AddCookie(&http.Cookie{Name: "session", Value: sessionToken})
+	}
+	return cb
+}
+
+func TestLinkRequiresSession(t *testing.T) {
+	s := newStubOIDC(t)
+	h := newOIDCHandler(t, s, nil)
+
+	w := httptest.NewRecorder()
+	h.Callback(w, startLink(t, h, s, &User{ID: "someone"}, ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	s := newStubOIDC(t)
+	h := newOIDCHandler(t, s, store)
+	ctx := context.Background()
+
+	// The provider's address differs from the account's; linking doesn't
+	// depend on it.
+	u := createTestUser(t, db, "linker@example.com")
+	sess, _ := store.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
+
+	w := httptest.NewRecorder()
+	h.Callback(w, startLink(t, h, s, u, sess.Token))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("callback: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	identities, _ := store.ListOAuthIdentities(ctx, u.ID)
+	if len(identities) != 1 || identities[0].Provider != "keycloak" || identities[0].Email != "kc@example.com" {
+		t.Fatalf("identities = %+v", identities)
+	}
+
+	// Another user can't link the same provider account.
+	other := createTestUser(t, db, "other@example.com")
+	otherSess, _ := store.CreateSession(ctx, other.ID, "test-agent", "127.0.0.1")
+	w = httptest.NewRecorder()
+	h.Callback(w, startLink(t, h, s, other, otherSess.Token))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("second link: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	// A link started by one user can't finish in another user's session.
+	w = httptest.NewRecorder()
+	h.Callback(w, startLink(t, h, s, other, sess.Token))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("mismatched session: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSignInAfterAbandonedLink(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	s := newStubOIDC(t)
+	h := newOIDCHandler(t, s, store)
+	u := createTestUser(t, db, "abandoned@example.com")
+
+	// The user starts linking but never comes back from the provider, then
+	// later signs in with it in the same browser.
+	abandoned := startLink(t, h, s, u, "")
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/oauth/keycloak", nil)
+	r.SetPathValue("provider", "keycloak")
+	w := httptest.NewRecorder()
+	h.Redirect(w, r)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	s.challenge = q.Get("code_challenge")
+	s.nonce = q.Get("nonce")
+
+	// The browser keeps the link cookie unless sign-in expired it.
+	jar := map[string]*http.Cookie{}
+	for _, c := range abandoned.Cookies() {
+		jar[c.Name] = c
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c
+		}
+	}
+	if _, ok := jar["oauth_link"]; ok {
+		t.Fatal("sign-in left the abandoned link cookie in place")
+	}
+
+	cb := httptest.NewRequest(http.MethodGet,
+		"/api/auth/oauth/keycloak/callback?code=good-code&state="+url.QueryEscape(q.Get("state")), nil)
+	cb.SetPathValue("provider", "keycloak")
+	for _, c := range jar {
+		cb.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	h.Callback(w, cb)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://app.test" {
+		t.Fatalf("callback: status = %d, location = %q; body = %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	var session bool
+	for _, c := range w.Result().Cookies() {
+		session = session || (c.Name == "session" && c.Value != "")
+	}
+	if !session {
+		t.Fatal("expected a session from the sign-in")
+	}
+	if identities, _ := store.ListOAuthIdentities(context.Background(), u.ID); len(identities) != 0 {
+		t.Fatalf("identity linked to the abandoned link's user: %+v", identities)
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"trello-clone/internal/httputil"
+)
+
+// loginLimit is the lockout policy for one scope of failed logins.
+type loginLimit struct {
+	// Free is how many failures are allowed before the first lockout.
+	Free int
+	// Base is the first lockout; each further failure doubles it, up to Max.
+	Base, Max time.Duration
+}
+
+var (
+	// accountLoginLimit slows down guessing one account's password.
+	accountLoginLimit = loginLimit{Free: 5, Base: time.Minute, Max: time.Hour}
+	// ipLoginLimit slows down one client trying many accounts. It is looser
+	// because offices and carrier NAT put many users behind one address.
+	ipLoginLimit = loginLimit{Free: 20, Base: time.Minute, Max: time.Hour}
+
+	// resetAccountLimit keeps one inbox from being flooded with reset links.
+	// Every request counts, whether or not an account has the address.
+	resetAccountLimit = loginLimit{Free: 3, Base: 15 * time.Minute, Max: 24 * time.Hour}
+	// resetIPLimit keeps one client from mailing many addresses.
+	resetIPLimit = loginLimit{Free: 20, Base: time.Minute, Max: time.Hour}
+)
+
+// loginFailureWindow is how long failures are remembered. A subject with no
+// failures for this long starts counting from zero again.
+const loginFailureWindow = 24 * time.Hour
+
+// lockout returns how long to lock a subject out after its failures-th
+// failure, or zero if it is still within the free attempts.
+func (l loginLimit) lockout(failures int) time.Duration {
+	over := failures - l.Free
+	if over <= 0 {
+		return 0
+	}
+	if over > 30 {
+		return l.Max
+	}
+	return min(l.Base*time.Duration(1<<(over-1)), l.Max)
+}
+
+// accountSubject identifies an account for login failures by its email.
+func accountSubject(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginLockout answers 429 with Retry-After and reports false if the
+// client or the account is locked out.
+func (h *Handler) checkLoginLockout(w http.ResponseWriter, r *http.Request, ip, email string) bool {
+	until, err := h.Store.LoginLockedUntil(r.Context(), ip, accountSubject(email))
+	return checkLockout(w, until, err, "too many failed logins, try again later")
+}
+
+// checkResetLockout is checkLoginLockout for password reset requests.
+func (h *Handler) checkResetLockout(w http.ResponseWriter, r *http.Request, ip, email string) bool {
+	until, err := h.Store.PasswordResetLockedUntil(r.Context(), ip, accountSubject(email))
+	return checkLockout(w, until, err, "too many password reset requests, try again later")
+}
+
+func checkLockout(w http.ResponseWriter, until time.Time, err error, msg string) bool {
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return false
+	}
+	if until.IsZero() {
+		return true
+	}
+	secs := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	httputil.Error(w, http.StatusTooManyRequests, msg)
+	return false
+}
+
+// limitedSubject is a scope and subject an attempt counts against.
+type limitedSubject struct {
+	scope, subject string
+	limit          loginLimit
+}
+
+// recordLoginFailure counts a failed login against the client and the
+// account, locking either out once it is past its free attempts.
+func (h *Handler) recordLoginFailure(ctx context.Context, ip, email string) error {
+	return h.recordAttempt(ctx,
+		limitedSubject{LoginScopeIP, ip, ipLoginLimit},
+		limitedSubject{LoginScopeAccount, accountSubject(email), accountLoginLimit},
+	)
+}
+
+// recordResetRequest counts a password reset request against the client and
+// the address, like recordLoginFailure.
+func (h *Handler) recordResetRequest(ctx context.Context, ip, email string) error {
+	return h.recordAttempt(ctx,
+		limitedSubject{LoginScopeResetIP, ip, resetIPLimit},
+		limitedSubject{LoginScopeResetAccount, accountSubject(email), resetAccountLimit},
+	)
+}
+
+func (h *Handler) recordAttempt(ctx context.Context, subjects ...limitedSubject) error {
+	since := time.Now().Add(-loginFailureWindow)
+	for _, f := range subjects {
+		n, err := h.Store.RecordLoginFailure(ctx, f.scope, f.subject, since)
+		if err != nil {
+			return err
+		}
+		if d := f.limit.lockout(n); d > 0 {
+			if err := h.Store.LockLogin(ctx, f.scope, f.subject, time.Now().Add(d)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginLimitLockout(t *testing.T) {
+	l := loginLimit{Free: 3, Base: time.Minute, Max: 10 * time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{6, 4 * time.Minute},
+		{7, 8 * time.Minute},
+		{8, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := l.lockout(tt.failures); got != tt.want {
+			t.Errorf("lockout(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestAccountSubject(t *testing.T) {
+	if got := accountSubject("  Ada@Example.COM "); got != "ada@example.com" {
+		t.Fatalf("subject = %q", got)
+	}
+}
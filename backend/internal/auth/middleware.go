@@ -3,21 +3,79 @@ package auth
 import (
 	"context"
 	"net/http"
+	"slices"
+	"strings"
 	"trello-clone/internal/httputil"
+	"trello-clone/internal/logging"
 )
 
 type contextKey string
 
-const userKey contextKey = "user"
+const (
+	userKey    contextKey = "user"
+	tokenKey   contextKey = "access_token"
+	sessionKey contextKey = "session"
+)
+
+// Scopes that can be granted to a personal access token. Session cookies
+// carry every scope.
+const (
+	ScopeBoardsRead   = "boards:read"
+	ScopeBoardsWrite  = "boards:write"
+	ScopeAccountRead  = "account:read"
+	ScopeAccountWrite = "account:write"
+)
+
+var validScopes = []string{ScopeBoardsRead, ScopeBoardsWrite, ScopeAccountRead, ScopeAccountWrite}
 
 func UserFromContext(ctx context.Context) *User {
 	u, _ := ctx.Value(userKey).(*User)
 	return u
 }
 
+// AccessTokenFromContext returns the personal access token that
+// authenticated the request, or nil for cookie sessions.
+func AccessTokenFromContext(ctx context.Context) *AccessToken {
+	t, _ := ctx.Value(tokenKey).(*AccessToken)
+	return t
+}
+
+// SessionFromContext returns the session that authenticated the request,
+// or nil for access tokens.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey).(*Session)
+	return s
+}
+
+// HasScope reports whether the token was granted scope.
+func (t *AccessToken) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(t.Scopes), scope)
+}
+
+// RequireAuth authenticates the request by its session cookie or, for API
+// clients, by an "Authorization: Bearer" personal access token.
 func RequireAuth(store *Store) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if bearer, ok := bearerToken(r); ok {
+				t, err := store.AccessTokenByValue(r.Context(), bearer)
+				if err != nil {
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					httputil.Error(w, http.StatusUnauthorized, "invalid token")
+					return
+				}
+				u, err := store.UserByID(r.Context(), t.UserID)
+				if err != nil {
+					httputil.Error(w, http.StatusUnauthorized, "user not found")
+					return
+				}
+				logging.SetUserID(r.Context(), u.ID)
+				ctx := context.WithValue(r.Context(), userKey, u)
+				ctx = context.WithValue(ctx, tokenKey, t)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
 			cookie, err := r.Cookie("session")
 			if err != nil {
 				httputil.Error(w, http.StatusUnauthorized, "not authenticated")
@@ -33,8 +91,48 @@ func RequireAuth(store *Store) func(http.Handler) http.Handler {
 				httputil.Error(w, http.StatusUnauthorized, "user not found")
 				return
 			}
+			logging.SetUserID(r.Context(), u.ID)
 			ctx := context.WithValue(r.Context(), userKey, u)
+			ctx = context.WithValue(ctx, sessionKey, sess)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// RequireScope rejects requests authenticated by an access token that lacks
+// scope. It must run after RequireAuth.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t := AccessTokenFromContext(r.Context()); t != nil && !t.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+				httputil.Error(w, http.StatusForbidden, "token lacks scope "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession rejects requests authenticated by an access token, for
+// endpoints that manage credentials: a leaked token must not be able to
+// mint more tokens, change the password or email, link an identity, sign
+// the owner out, turn off 2FA or delete the account. It must run after
+// RequireAuth.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if AccessTokenFromContext(r.Context()) != nil {
+			httputil.Error(w, http.StatusForbidden, "this endpoint requires a session, not an access token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"trello-clone/internal/testutil"
@@ -61,7 +62,7 @@ func TestRequireAuthValid(t *testing.T) {
 
 	hash, _ := HashPassword("password123")
 	u, _ := store.CreateUser(ctx, "valid@example.com", hash, "Valid")
-	sess, _ := store.CreateSession(ctx, u.ID)
+	sess, _ := store.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
 
 	middleware := RequireAuth(store)
 
@@ -94,3 +95,114 @@ func TestUserFromContextNil(t *testing.T) {
 		t.Fatal("expected nil user from empty context")
 	}
 }
+
+func TestRequireAuthBearerToken(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "bearer@example.com")
+	token, _, err := store.CreateAccessToken(ctx, u.ID, "ci", []string{ScopeBoardsRead}, nil)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	var gotUser *User
+	var gotToken *AccessToken
+	handler := RequireAuth(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser = UserFromContext(r.Context())
+		gotToken = AccessTokenFromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if gotUser == nil || gotUser.ID != u.ID {
+		t.Fatalf("user = %v, want %s", gotUser, u.ID)
+	}
+	if gotToken == nil || !gotToken.HasScope(ScopeBoardsRead) {
+		t.Fatalf("token = %+v, want boards:read token in context", gotToken)
+	}
+}
+
+func TestRequireAuthBearerTokenExpired(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "expired-bearer@example.com")
+	token, created, _ := store.CreateAccessToken(ctx, u.ID, "old", []string{ScopeBoardsRead}, nil)
+	db.ExecContext(ctx, "UPDATE access_tokens SET expires_at = now() - interval '1 hour' WHERE id=$1", created.ID)
+
+	handler := RequireAuth(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("next handler should not have been called")
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("expected WWW-Authenticate header")
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	handler := RequireScope(ScopeBoardsWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name  string
+		token *AccessToken
+		want  int
+	}{
+		{"session", nil, http.StatusOK},
+		{"token with scope", &AccessToken{Scopes: "boards:read boards:write"}, http.StatusOK},
+		{"token without scope", &AccessToken{Scopes: "boards:read"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.token != nil {
+				r = r.WithContext(context.WithValue(r.Context(), tokenKey, tt.token))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	handler := RequireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("session: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Even a token with every scope is turned away.
+	token := &AccessToken{Scopes: strings.Join(validScopes, " ")}
+	r = r.WithContext(context.WithValue(r.Context(), tokenKey, token))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("token: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
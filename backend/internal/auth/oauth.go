@@ -3,11 +3,17 @@ package auth
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	microsoftEndpoint "golang.org/x/oauth2/microsoft"
@@ -16,10 +22,38 @@ import (
 type OAuthConfig struct {
 	Google    *oauth2.Config
 	Microsoft *oauth2.Config
+	// OIDC holds the generic OpenID Connect providers by name.
+	OIDC map[string]*OIDCProvider
+
+	baseURL string
+	// builtin holds the userinfo and ID token settings of Google and
+	// Microsoft, by provider name.
+	builtin map[string]*builtinProvider
 }
 
 func NewOAuthConfig(baseURL, googleID, googleSecret, msID, msSecret string) *OAuthConfig {
-	cfg := &OAuthConfig{}
+	cfg := &OAuthConfig{
+		OIDC:    map[string]*OIDCProvider{},
+		baseURL: baseURL,
+		builtin: map[string]*builtinProvider{
+			"google": {
+				userInfoURL:  "https://www.googleapis.com/oauth2/v2/userinfo",
+				parse:        parseGoogleUserInfo,
+				keys:         oidc.NewRemoteKeySet(context.Background(), "https://www.googleapis.com/oauth2/v3/certs"),
+				subjectClaim: "sub",
+				issuers:      []string{"https://accounts.google.com", "accounts.google.com"},
+			},
+			// The multi-tenant endpoint issues tokens from each user's own
+			// tenant. Graph's user id is the token's oid, not its sub.
+			"microsoft": {
+				userInfoURL:  "https://graph.microsoft.com/v1.0/me",
+				parse:        parseGraphUser,
+				keys:         oidc.NewRemoteKeySet(context.Background(), "https://login.microsoftonline.com/common/discovery/v2.0/keys"),
+				subjectClaim: "oid",
+				issuers:      []string{"https://login.microsoftonline.com/{tenantid}/v2.0"},
+			},
+		},
+	}
 	if googleID != "" {
 		cfg.Google = &oauth2.Config{
 			ClientID:     googleID,
@@ -46,141 +80,351 @@ type OAuthHandler struct {
 	Store        *Store
 	CookieDomain string
 	BaseURL      string
+	// RedirectAllowlist holds the origins, besides BaseURL's, that a login
+	// may return to through ?redirect_to=.
+	RedirectAllowlist []string
 }
 
-func (h *OAuthHandler) providerConfig(provider string) *oauth2.Config {
+// providerConfig returns the OAuth2 config for provider, or nil if it isn't
+// configured. OIDC providers are discovered on first use.
+func (h *OAuthHandler) providerConfig(ctx context.Context, provider string) (*oauth2.Config, error) {
 	switch provider {
 	case "google":
-		return h.Config.Google
+		return h.Config.Google, nil
 	case "microsoft":
-		return h.Config.Microsoft
+		return h.Config.Microsoft, nil
 	}
-	return nil
+	if p := h.Config.OIDC[provider]; p != nil {
+		return p.discover(ctx)
+	}
+	return nil, nil
 }
 
+// Redirect sends the browser to the provider to sign in.
 func (h *OAuthHandler) Redirect(w http.ResponseWriter, r *http.Request) {
+	authURL, status, err := h.beginFlow(w, r, "")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
+}
+
+// beginFlow starts a sign-in, or a link for linkUserID if set, with the
+// provider in the path and returns the provider's authorization URL. The
+// state, PKCE verifier and nonce are kept in short-lived cookies for the
+// callback; the state cookie also records the provider, so a callback for
+// another provider is refused. On failure it returns the status to answer
+// with.
+func (h *OAuthHandler) beginFlow(w http.ResponseWriter, r *http.Request, linkUserID string) (string, int, error) {
 	provider := r.PathValue("provider")
-	cfg := h.providerConfig(provider)
+	cfg, err := h.providerConfig(r.Context(), provider)
+	if err != nil {
+		return "", http.StatusBadGateway, errors.New("identity provider unavailable")
+	}
 	if cfg == nil {
-		http.Error(w, "unsupported provider", http.StatusBadRequest)
-		return
+		return "", http.StatusBadRequest, errors.New("unsupported provider")
 	}
 
-	state, _ := generateState()
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    state,
-		Path:     "/",
-		MaxAge:   600,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
-	http.Redirect(w, r, cfg.AuthCodeURL(state), http.StatusTemporaryRedirect)
+	redirectTo := r.URL.Query().Get("redirect_to")
+	if redirectTo != "" && !h.allowedRedirect(redirectTo) {
+		return "", http.StatusBadRequest, errors.New("redirect_to not allowed")
+	}
+
+	state, err := generateState()
+	if err != nil {
+		return "", http.StatusInternalServerError, errors.New("internal error")
+	}
+	nonce, err := generateState()
+	if err != nil {
+		return "", http.StatusInternalServerError, errors.New("internal error")
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	setOAuthCookie(w, "oauth_state", provider+":"+state)
+	setOAuthCookie(w, "oauth_verifier", verifier)
+	setOAuthCookie(w, "oauth_nonce", nonce)
+	// Empty values expire what an abandoned earlier flow left behind, so a
+	// plain sign-in doesn't turn into a link or land on an old destination.
+	setOAuthCookie(w, "oauth_redirect", redirectTo)
+	setOAuthCookie(w, "oauth_link", linkUserID)
+	// PKCE binds the code to this browser; the nonce binds the ID token to
+	// this login.
+	return cfg.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)), 0, nil
 }
 
 func (h *OAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
 	provider := r.PathValue("provider")
-	cfg := h.providerConfig(provider)
+	cfg, err := h.providerConfig(r.Context(), provider)
+	if err != nil {
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
 	if cfg == nil {
 		http.Error(w, "unsupported provider", http.StatusBadRequest)
 		return
 	}
 
 	stateCookie, err := r.Cookie("oauth_state")
-	if err != nil || stateCookie.Value != r.URL.Query().Get("state") {
+	if err != nil || !constantTimeEqual(stateCookie.Value, provider+":"+r.URL.Query().Get("state")) {
 		http.Error(w, "invalid state", http.StatusBadRequest)
 		return
 	}
+	verifier, err := r.Cookie("oauth_verifier")
+	if err != nil {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	nonce, err := r.Cookie("oauth_nonce")
+	if err != nil {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	redirectTo := h.BaseURL
+	if c, err := r.Cookie("oauth_redirect"); err == nil && h.allowedRedirect(c.Value) {
+		redirectTo = h.redirectURL(c.Value)
+	}
+	linkCookie, linkErr := r.Cookie("oauth_link")
+	for _, name := range []string{"oauth_state", "oauth_verifier", "oauth_nonce", "oauth_redirect", "oauth_link"} {
+		setOAuthCookie(w, name, "")
+	}
 
-	token, err := cfg.Exchange(r.Context(), r.URL.Query().Get("code"))
+	token, err := cfg.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier.Value))
 	if err != nil {
 		http.Error(w, "oauth exchange failed", http.StatusBadRequest)
 		return
 	}
 
-	info, err := fetchUserInfo(r.Context(), provider, cfg, token)
+	var info *userInfo
+	if p := h.Config.OIDC[provider]; p != nil {
+		info, err = p.userInfo(r.Context(), token, nonce.Value)
+	} else {
+		info, err = h.Config.builtin[provider].userInfo(r.Context(), cfg, token, nonce.Value)
+	}
+	var idErr *idTokenError
+	if errors.As(err, &idErr) {
+		http.Error(w, "invalid id token", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to get user info", http.StatusInternalServerError)
 		return
 	}
 
-	u, err := h.Store.FindOrCreateOAuthUser(r.Context(), provider, info.ID, info.Email, info.Name)
+	if linkErr == nil && linkCookie.Value != "" {
+		h.finishLink(w, r, linkCookie.Value, provider, info, redirectTo)
+		return
+	}
+
+	u, err := h.Store.FindOrCreateOAuthUser(r.Context(), provider, info.ID, info.Email, info.Name, info.EmailVerified)
+	if errors.Is(err, ErrEmailNotVerified) {
+		http.Error(w, "an account with this email already exists; sign in with your password instead", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to create user", http.StatusInternalServerError)
 		return
 	}
 
-	sess, err := h.Store.CreateSession(r.Context(), u.ID)
-	if err != nil {
+	// The provider only stands in for the password; 2FA still applies.
+	if u.TwoFactorEnabled {
+		challenge, err := h.Store.CreateLoginChallenge(r.Context(), u.ID, loginChallengeTTL)
+		if err != nil {
+			http.Error(w, "failed to create login challenge", http.StatusInternalServerError)
+			return
+		}
+		q := url.Values{"challenge": {challenge}}
+		if redirectTo != h.BaseURL {
+			q.Set("redirect_to", redirectTo)
+		}
+		http.Redirect(w, r, h.BaseURL+"/login?"+q.Encode(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	if err := startSession(w, r, h.Store, h.CookieDomain, u.ID); err != nil {
 		http.Error(w, "failed to create session", http.StatusInternalServerError)
 		return
 	}
+	http.Redirect(w, r, redirectTo, http.StatusTemporaryRedirect)
+}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sess.Token,
-		Path:     "/",
-		Domain:   h.CookieDomain,
-		MaxAge:   30 * 24 * 60 * 60,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
+// allowedRedirect reports whether a login may return to target: a path on
+// the frontend, or an absolute http(s) URL on BaseURL's origin or one in
+// RedirectAllowlist.
+func (h *OAuthHandler) allowedRedirect(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil || strings.ContainsAny(target, "\\\r\n") {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		// "//evil.example" has no scheme but does have a host.
+		return strings.HasPrefix(u.Path, "/")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	origin := u.Scheme + "://" + u.Host
+	return slices.ContainsFunc(append([]string{h.BaseURL}, h.RedirectAllowlist...), func(allowed string) bool {
+		return strings.TrimSuffix(strings.TrimSpace(allowed), "/") == origin
 	})
-	http.Redirect(w, r, h.BaseURL, http.StatusTemporaryRedirect)
+}
+
+// redirectURL resolves an allowed redirect_to against BaseURL.
+func (h *OAuthHandler) redirectURL(target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimSuffix(h.BaseURL, "/") + target
+	}
+	return target
 }
 
 type userInfo struct {
 	ID    string
 	Email string
 	Name  string
+	// EmailVerified is whether the provider vouches for Email.
+	EmailVerified bool
 }
 
-func fetchUserInfo(ctx context.Context, provider string, cfg *oauth2.Config, token *oauth2.Token) (*userInfo, error) {
-	client := cfg.Client(ctx, token)
+// idTokenError marks a sign-in refused because the ID token didn't check
+// out, as opposed to the provider being unreachable.
+type idTokenError struct{ err error }
 
-	var url string
-	switch provider {
-	case "google":
-		url = "https://www.googleapis.com/oauth2/v2/userinfo"
-	case "microsoft":
-		url = "https://graph.microsoft.com/v1.0/me"
-	default:
-		return nil, fmt.Errorf("unsupported provider: %s", provider)
+func (e *idTokenError) Error() string { return "id token: " + e.err.Error() }
+func (e *idTokenError) Unwrap() error { return e.err }
+
+// builtinProvider is what Google and Microsoft need besides their OAuth2
+// config: where to read the profile, and how to check the ID token.
+type builtinProvider struct {
+	userInfoURL string
+	parse       func(data map[string]any) *userInfo
+	keys        oidc.KeySet
+	// subjectClaim is the ID token claim holding the userinfo id.
+	subjectClaim string
+	// issuers are the accepted iss values; "{tenantid}" stands for the
+	// token's tid claim.
+	issuers []string
+}
+
+// userInfo checks the ID token, then reads the profile and makes sure it
+// belongs to the user the ID token names.
+func (b *builtinProvider) userInfo(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, nonce string) (*userInfo, error) {
+	subject, err := b.verifyIDToken(ctx, cfg.ClientID, token, nonce)
+	if err != nil {
+		return nil, &idTokenError{err}
+	}
+	info, err := b.fetchUserInfo(ctx, cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	if info.ID != subject {
+		return nil, &idTokenError{errors.New("subject does not match userinfo")}
+	}
+	return info, nil
+}
+
+// verifyIDToken checks the token's signature against the provider's keys,
+// its audience, expiry, issuer and nonce, and returns its subject.
+func (b *builtinProvider) verifyIDToken(ctx context.Context, clientID string, token *oauth2.Token, nonce string) (string, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return "", errors.New("no id_token in token response")
+	}
+	// The issuer is checked below, since Microsoft's depends on the tenant.
+	verifier := oidc.NewVerifier("", b.keys, &oidc.Config{ClientID: clientID, SkipIssuerCheck: true})
+	idToken, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return "", err
+	}
+	if err := checkNonce(idToken, nonce); err != nil {
+		return "", err
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return "", err
+	}
+	tenant, _ := claims["tid"].(string)
+	if !slices.ContainsFunc(b.issuers, func(iss string) bool {
+		return strings.ReplaceAll(iss, "{tenantid}", tenant) == idToken.Issuer
+	}) {
+		return "", fmt.Errorf("unexpected issuer %q", idToken.Issuer)
 	}
+	subject, _ := claims[b.subjectClaim].(string)
+	if subject == "" {
+		return "", fmt.Errorf("no %s claim", b.subjectClaim)
+	}
+	return subject, nil
+}
 
-	resp, err := client.Get(url)
+func (b *builtinProvider) fetchUserInfo(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (*userInfo, error) {
+	client := cfg.Client(ctx, token)
+	resp, err := client.Get(b.userInfoURL)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo: %s", resp.Status)
+	}
 
 	var data map[string]any
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
 		return nil, err
 	}
 
-	info := &userInfo{}
-	switch provider {
-	case "google":
-		info.ID = fmt.Sprint(data["id"])
-		info.Email, _ = data["email"].(string)
-		info.Name, _ = data["name"].(string)
-	case "microsoft":
-		info.ID = fmt.Sprint(data["id"])
-		info.Email, _ = data["mail"].(string)
-		if info.Email == "" {
-			info.Email, _ = data["userPrincipalName"].(string)
-		}
-		info.Name, _ = data["displayName"].(string)
+	info := b.parse(data)
+	if info.Email == "" {
+		return nil, errors.New("no email in userinfo")
 	}
+	return info, nil
+}
 
+func parseGoogleUserInfo(data map[string]any) *userInfo {
+	info := &userInfo{ID: fmt.Sprint(data["id"])}
+	info.Email, _ = data["email"].(string)
+	info.Name, _ = data["name"].(string)
+	info.EmailVerified, _ = data["verified_email"].(bool)
+	return info
+}
+
+// parseGraphUser reads a Microsoft Graph user. Its mail and
+// userPrincipalName are set by the tenant and not verified, so they are
+// never trusted for linking.
+func parseGraphUser(data map[string]any) *userInfo {
+	info := &userInfo{ID: fmt.Sprint(data["id"])}
+	info.Email, _ = data["mail"].(string)
 	if info.Email == "" {
-		return nil, fmt.Errorf("no email from %s", provider)
+		info.Email, _ = data["userPrincipalName"].(string)
 	}
-	return info, nil
+	info.Name, _ = data["displayName"].(string)
+	return info
+}
+
+// setOAuthCookie stores a value for the duration of one sign-in; an empty
+// value deletes the cookie.
+func setOAuthCookie(w http.ResponseWriter, name, value string) {
+	maxAge := 600
+	if value == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 func generateState() (string, error) {
 	b := make([]byte, 16)
-	rand.Read(b)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
 	return hex.EncodeToString(b), nil
 }
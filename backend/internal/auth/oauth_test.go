@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"trello-clone/internal/testutil"
+)
+
+// newBuiltinHandler returns a handler whose Google and Microsoft providers
+// talk to the stub instead of the real services.
+func newBuiltinHandler(t *testing.T, s *stubOIDC, store *Store) *OAuthHandler {
+	t.Helper()
+	cfg := NewOAuthConfig("http://api.test", s.clientID, "secret", s.clientID, "secret")
+	endpoint := oauth2.Endpoint{AuthURL: s.URL + "/authorize", TokenURL: s.URL + "/token"}
+	cfg.Google.Endpoint = endpoint
+	cfg.Microsoft.Endpoint = endpoint
+
+	keys := oidc.NewRemoteKeySet(context.Background(), s.URL+"/jwks")
+	google := cfg.builtin["google"]
+	google.userInfoURL = s.URL + "/oauth2/v2/userinfo"
+	google.keys = keys
+	google.issuers = []string{s.URL}
+	microsoft := cfg.builtin["microsoft"]
+	microsoft.userInfoURL = s.URL + "/v1.0/me"
+	microsoft.keys = keys
+	microsoft.issuers = []string{s.URL + "/{tenantid}/v2.0"}
+
+	return &OAuthHandler{
+		Config:            cfg,
+		Store:             store,
+		BaseURL:           "http://app.test",
+		RedirectAllowlist: []string{"https://admin.example.com"},
+	}
+}
+
+// microsoftClaims makes the stub issue tokens like Microsoft's multi-tenant
+// endpoint.
+func microsoftClaims(s *stubOIDC) {
+	s.claims["tid"] = "tenant-1"
+	s.claims["oid"] = "ms-object-id"
+	s.claims["iss"] = s.URL + "/tenant-1/v2.0"
+}
+
+func TestAllowedRedirect(t *testing.T) {
+	h := &OAuthHandler{BaseURL: "http://app.test", RedirectAllowlist: []string{"https://admin.example.com/"}}
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"/boards/42", true},
+		{"/boards/42?card=7#c", true},
+		{"http://app.test/boards", true},
+		{"https://admin.example.com/dash", true},
+		{"https://evil.example.com/", false},
+		{"//evil.example.com/", false},
+		{"/\\evil.example.com", false},
+		{"boards", false},
+		{"javascript:alert(1)", false},
+		{"https://admin.example.com@evil.example.com/", false},
+		{"https://user@admin.example.com/", false},
+		{"http://admin.example.com/", false},
+	}
+	for _, tt := range tests {
+		if got := h.allowedRedirect(tt.target); got != tt.ok {
+			t.Errorf("allowedRedirect(%q) = %v, want %v", tt.target, got, tt.ok)
+		}
+	}
+	if got := h.redirectURL("/boards/42"); got != "http://app.test/boards/42" {
+		t.Errorf("redirectURL = %q", got)
+	}
+}
+
+func TestOAuthRedirectPKCEAndNonce(t *testing.T) {
+	s := newStubOIDC(t)
+	h := newBuiltinHandler(t, s, nil)
+
+	for _, provider := range []string{"google", "microsoft"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/auth/oauth/"+provider, nil)
+		r.SetPathValue("provider", provider)
+		w := httptest.NewRecorder()
+		h.Redirect(w, r)
+
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		q := loc.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" {
+			t.Fatalf("%s: missing PKCE or nonce: %s", provider, loc)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "oauth_state" && c.Value != provider+":"+q.Get("state") {
+				t.Fatalf("%s: state cookie %q not bound to the provider", provider, c.Value)
+			}
+		}
+	}
+}
+
+func TestOAuthRedirectRejectsRedirectTo(t *testing.T) {
+	s := newStubOIDC(t)
+	h := newBuiltinHandler(t, s, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/oauth/google?redirect_to="+url.QueryEscape("https://evil.example.com/"), nil)
+	r.SetPathValue("provider", "google")
+	w := httptest.NewRecorder()
+	h.Redirect(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOAuthCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		setup    func(s *stubOIDC, cb *http.Request) *http.Request
+	}{
+		{"state from another provider", "google", func(s *stubOIDC, cb *http.Request) *http.Request {
+			r := cb.Clone(cb.Context())
+			r.SetPathValue("provider", "microsoft")
+			return r
+		}},
+		{"missing PKCE verifier", "google", func(s *stubOIDC, cb *http.Request) *http.Request {
+			r := cb.Clone(cb.Context())
+			r.Header.Del("Cookie")
+			for _, c := range cb.Cookies() {
+				if c.Name != "oauth_verifier" {
+					r.AddCookie(c)
+				}
+			}
+			return r
+		}},
+		{"wrong nonce", "google", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.nonce = "replayed-nonce"
+			return cb
+		}},
+		{"unknown signing key", "google", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.signKey = newStubOIDC(t).key
+			return cb
+		}},
+		{"userinfo for another user", "google", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.userInfoID = "someone-else"
+			return cb
+		}},
+		{"issuer from another tenant", "microsoft", func(s *stubOIDC, cb *http.Request) *http.Request {
+			microsoftClaims(s)
+			s.claims["iss"] = s.URL + "/tenant-2/v2.0"
+			return cb
+		}},
+		{"graph user for another object id", "microsoft", func(s *stubOIDC, cb *http.Request) *http.Request {
+			microsoftClaims(s)
+			s.userInfoID = "other-object-id"
+			return cb
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStubOIDC(t)
+			h := newBuiltinHandler(t, s, nil)
+			cb := tt.setup(s, oauthLogin(t, h, s, tt.provider, ""))
+
+			w := httptest.NewRecorder()
+			h.Callback(w, cb)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusBadRequest, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestOAuthCallbackRedirectTo(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	s := newStubOIDC(t)
+	microsoftClaims(s)
+	h := newBuiltinHandler(t, s, store)
+
+	cb := oauthLogin(t, h, s, "microsoft", "redirect_to="+url.QueryEscape("/boards/42"))
+	w := httptest.NewRecorder()
+	h.Callback(w, cb)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://app.test/boards/42" {
+		t.Fatalf("status = %d, location = %q; body = %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+
+	// Graph ids are the token's oid; Microsoft emails are never verified.
+	var providerID string
+	db.QueryRow("SELECT provider_id FROM oauth_accounts WHERE provider='microsoft'").Scan(&providerID)
+	if providerID != "ms-object-id" {
+		t.Fatalf("provider_id = %q", providerID)
+	}
+	u, err := store.UserByEmail(context.Background(), "kc@example.com")
+	if err != nil || u.EmailVerifiedAt != nil {
+		t.Fatalf("user = %+v, err = %v", u, err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if strings.HasPrefix(c.Name, "oauth_") && c.MaxAge >= 0 {
+			t.Errorf("cookie %s not cleared", c.Name)
+		}
+	}
+}
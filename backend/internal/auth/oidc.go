@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProviderConfig configures a generic OpenID Connect provider such as
+// Keycloak.
+type OIDCProviderConfig struct {
+	// Name identifies the provider in URLs (/api/auth/oauth/{name}) and in
+	// linked accounts, so it must not change once users have signed in.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested in addition to openid, email and profile.
+	Scopes []string
+}
+
+var oidcNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// AddOIDC registers a generic OpenID Connect provider. Names are lowercase
+// letters, digits and dashes, and can't clash with a built-in provider.
+func (c *OAuthConfig) AddOIDC(pc OIDCProviderConfig) error {
+	if !oidcNamePattern.MatchString(pc.Name) {
+		return fmt.Errorf("oidc provider name %q: use lowercase letters, digits and dashes", pc.Name)
+	}
+	if pc.Name == "google" || pc.Name == "microsoft" || c.OIDC[pc.Name] != nil {
+		return fmt.Errorf("oidc provider %q already registered", pc.Name)
+	}
+	if pc.Issuer == "" || pc.ClientID == "" {
+		return fmt.Errorf("oidc provider %q: issuer and client ID required", pc.Name)
+	}
+	c.OIDC[pc.Name] = &OIDCProvider{
+		config:      pc,
+		redirectURL: c.baseURL + "/api/auth/oauth/" + pc.Name + "/callback",
+	}
+	return nil
+}
+
+// OIDCProvider is a registered OpenID Connect provider. Its endpoints and
+// signing keys come from the issuer's discovery document, fetched on first
+// use and retried until it succeeds, so an issuer that is down doesn't stop
+// the server from starting.
+type OIDCProvider struct {
+	config      OIDCProviderConfig
+	redirectURL string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// discover returns the provider's OAuth2 config, running discovery if it
+// hasn't succeeded yet.
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc %s: discovery: %w", p.config.Name, err)
+	}
+	p.provider = provider
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID, "email", "profile"}, p.config.Scopes...),
+		Endpoint:     provider.Endpoint(),
+	}
+	return p.oauth2, nil
+}
+
+// oidcClaims are the standard claims read from the ID token or userinfo.
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// userInfo verifies the ID token in token — signature (against the
+// issuer's JWKS), issuer, audience, expiry and nonce — and returns the user
+// it identifies. Claims missing from the ID token are read from the
+// userinfo endpoint.
+func (p *OIDCProvider) userInfo(ctx context.Context, token *oauth2.Token, nonce string) (*userInfo, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return nil, &idTokenError{errors.New("no id_token in token response")}
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, &idTokenError{err}
+	}
+	if err := checkNonce(idToken, nonce); err != nil {
+		return nil, &idTokenError{err}
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if claims.Email == "" {
+		ui, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err != nil {
+			return nil, err
+		}
+		if ui.Subject != idToken.Subject {
+			return nil, &idTokenError{errors.New("subject does not match userinfo")}
+		}
+		if err := ui.Claims(&claims); err != nil {
+			return nil, err
+		}
+	}
+	if claims.Email == "" {
+		return nil, fmt.Errorf("no email from %s", p.config.Name)
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.PreferredUsername
+	}
+	return &userInfo{
+		ID:            idToken.Subject,
+		Email:         claims.Email,
+		Name:          name,
+		EmailVerified: claims.EmailVerified,
+	}, nil
+}
+
+// checkNonce makes sure the ID token was issued for this login.
+func checkNonce(idToken *oidc.IDToken, nonce string) error {
+	if nonce == "" || !constantTimeEqual(idToken.Nonce, nonce) {
+		return errors.New("nonce mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"trello-clone/internal/testutil"
+)
+
+// stubOIDC is a minimal OpenID Connect provider: discovery, JWKS, a token
+// endpoint that checks PKCE, and userinfo in standard, Google and Microsoft
+// Graph shapes. The authorization step is skipped; tests copy the challenge
+// and nonce from the redirect URL.
+type stubOIDC struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	// Set from the authorization request.
+	challenge string
+	nonce     string
+
+	// Claims for the issued ID token; Audience defaults to clientID.
+	claims map[string]any
+	// signKey, if set, signs ID tokens instead of the published key.
+	signKey *rsa.PrivateKey
+	// userInfoID, if set, is the id the Google and Graph userinfo endpoints
+	// return instead of the ID token's sub or oid.
+	userInfoID string
+}
+
+func newStubOIDC(t *testing.T) *stubOIDC {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubOIDC{key: key, clientID: "flowboard"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/jwks",
+			"userinfo_endpoint":                     s.URL + "/userinfo",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != s.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "stub-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     s.idToken(t),
+		})
+	})
+	mux.HandleFunc("GET /userinfo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"sub":            s.claims["sub"],
+			"email":          "userinfo@example.com",
+			"email_verified": true,
+		})
+	})
+	mux.HandleFunc("GET /oauth2/v2/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":             s.builtinUserID("sub"),
+			"email":          s.claims["email"],
+			"verified_email": s.claims["email_verified"],
+			"name":           s.claims["name"],
+		})
+	})
+	mux.HandleFunc("GET /v1.0/me", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":          s.builtinUserID("oid"),
+			"mail":        s.claims["email"],
+			"displayName": s.claims["name"],
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	s.claims = map[string]any{
+		"sub":            "kc-user-1",
+		"email":          "kc@example.com",
+		"email_verified": true,
+		"name":           "Keycloak User",
+	}
+	return s
+}
+
+func (s *stubOIDC) builtinUserID(claim string) any {
+	if s.userInfoID != "" {
+		return s.userInfoID
+	}
+	return s.claims[claim]
+}
+
+func (s *stubOIDC) idToken(t *testing.T) string {
+	claims := map[string]any{
+		"iss":   s.URL,
+		"aud":   s.clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": s.nonce,
+	}
+	for k, v := range s.claims {
+		claims[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	key := s.key
+	if s.signKey != nil {
+		key = s.signKey
+	}
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCHandler(t *testing.T, s *stubOIDC, store *Store) *OAuthHandler {
+	t.Helper()
+	cfg := NewOAuthConfig("http://api.test", "", "", "", "")
+	if err := cfg.AddOIDC(OIDCProviderConfig{
+		Name:         "keycloak",
+		Issuer:       s.URL,
+		ClientID:     s.clientID,
+		ClientSecret: "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return &OAuthHandler{Config: cfg, Store: store, BaseURL: "http://app.test"}
+}
+
+// oauthLogin runs the redirect step for provider, with query appended to
+// the redirect URL, and returns the callback request the browser would make
+// after the provider approves it.
+func oauthLogin(t *testing.T, h *OAuthHandler, s *stubOIDC, provider, query string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/oauth/"+provider+"?"+query, nil)
+	r.SetPathValue("provider", provider)
+	w := httptest.NewRecorder()
+	h.Redirect(w, r)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("redirect: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	s.challenge = q.Get("code_challenge")
+	s.nonce = q.Get("nonce")
+
+	cb := httptest.NewRequest(http.MethodGet,
+		"/api/auth/oauth/"+provider+"/callback?code=good-code&state="+url.QueryEscape(q.Get("state")), nil)
+	cb.SetPathValue("provider", provider)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			cb.AddCookie(c)
+		}
+	}
+	return cb
+}
+
+func TestAddOIDC(t *testing.T) {
+	cfg := NewOAuthConfig("http://api.test", "", "", "", "")
+	valid := OIDCProviderConfig{Name: "keycloak", Issuer: "https://sso.example.com/realms/main", ClientID: "flowboard"}
+	if err := cfg.AddOIDC(valid); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if got := cfg.OIDC["keycloak"].redirectURL; got != "http://api.test/api/auth/oauth/keycloak/callback" {
+		t.Fatalf("redirect URL = %s", got)
+	}
+
+	for _, name := range []string{"keycloak", "google", "microsoft", "", "Corp", "a/b", "-x"} {
+		pc := valid
+		pc.Name = name
+		if err := cfg.AddOIDC(pc); err == nil {
+			t.Errorf("AddOIDC(%q) should fail", name)
+		}
+	}
+	if err := cfg.AddOIDC(OIDCProviderConfig{Name: "other", ClientID: "x"}); err == nil {
+		t.Error("missing issuer should fail")
+	}
+}
+
+func TestOIDCRedirect(t *testing.T) {
+	s := newStubOIDC(t)
+	h := newOIDCHandler(t, s, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/oauth/keycloak", nil)
+	r.SetPathValue("provider", "keycloak")
+	w := httptest.NewRecorder()
+	h.Redirect(w, r)
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), s.URL+"/authorize?") {
+		t.Fatalf("location = %q", w.Header().Get("Location"))
+	}
+	q := loc.Query()
+	checks := map[string]string{
+		"client_id":             "flowboard",
+		"redirect_uri":          "http://api.test/api/auth/oauth/keycloak/callback",
+		"response_type":         "code",
+		"code_challenge_method": "S256",
+		"scope":                 "openid email profile",
+	}
+	for k, want := range checks {
+		if got := q.Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+	if q.Get("code_challenge") == "" || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("missing challenge, nonce or state: %s", loc)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *stubOIDC, cb *http.Request) *http.Request
+	}{
+		{"wrong nonce", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.nonce = "someone-elses-nonce"
+			return cb
+		}},
+		{"unknown signing key", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.signKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+			return cb
+		}},
+		{"wrong audience", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.claims["aud"] = "another-client"
+			return cb
+		}},
+		{"expired", func(s *stubOIDC, cb *http.Request) *http.Request {
+			s.claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return cb
+		}},
+		{"wrong PKCE verifier", func(s *stubOIDC, cb *http.Request) *http.Request {
+			r := cb.Clone(cb.Context())
+			r.Header.Del("Cookie")
+			for _, c := range cb.Cookies() {
+				if c.Name == "oauth_verifier" {
+					c.Value = "not-the-verifier-not-the-verifier-not-the-verifier"
+				}
+				r.AddCookie(c)
+			}
+			return r
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStubOIDC(t)
+			h := newOIDCHandler(t, s, nil)
+			cb := tt.setup(s, oauthLogin(t, h, s, "keycloak", ""))
+
+			w := httptest.NewRecorder()
+			h.Callback(w, cb)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusBadRequest, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackSignsIn(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	s := newStubOIDC(t)
+	h := newOIDCHandler(t, s, store)
+
+	w := httptest.NewRecorder()
+	h.Callback(w, oauthLogin(t, h, s, "keycloak", ""))
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://app.test" {
+		t.Fatalf("status = %d, location = %q; body = %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+
+	var session string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session" {
+			session = c.Value
+		}
+	}
+	sess, err := store.SessionByToken(context.Background(), session)
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+	u, _ := store.UserByID(context.Background(), sess.UserID)
+	if u.Email != "kc@example.com" || u.Name != "Keycloak User" || u.EmailVerifiedAt == nil {
+		t.Fatalf("user = %+v", u)
+	}
+
+	var providerID string
+	db.QueryRow("SELECT provider_id FROM oauth_accounts WHERE provider='keycloak' AND user_id=$1", u.ID).Scan(&providerID)
+	if providerID != "kc-user-1" {
+		t.Fatalf("provider_id = %q, want the ID token subject", providerID)
+	}
+}
+
+func TestOIDCEmailFromUserInfo(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	s := newStubOIDC(t)
+	delete(s.claims, "email")
+	delete(s.claims, "email_verified")
+	h := newOIDCHandler(t, s, store)
+
+	w := httptest.NewRecorder()
+	h.Callback(w, oauthLogin(t, h, s, "keycloak", ""))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("status = %d; body = %s", w.Code, w.Body.String())
+	}
+	if _, err := store.UserByEmail(context.Background(), "userinfo@example.com"); err != nil {
+		t.Fatalf("user from userinfo email: %v", err)
+	}
+}
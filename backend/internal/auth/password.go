@@ -1,6 +1,10 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 func HashPassword(password string) (string, error) {
 	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -10,3 +14,15 @@ func HashPassword(password string) (string, error) {
 func CheckPassword(hash, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
+
+// dummyPasswordHash is compared against when there is no real hash to check,
+// so a login for an unknown email costs as much as a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	h, _ := HashPassword("dummy password for constant-time login")
+	return h
+})
+
+// CheckDummyPassword does the work of CheckPassword and always fails.
+func CheckDummyPassword(password string) {
+	CheckPassword(dummyPasswordHash(), password)
+}
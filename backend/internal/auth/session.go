@@ -2,7 +2,12 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 )
 
 func GenerateToken() (string, error) {
@@ -12,3 +17,57 @@ func GenerateToken() (string, error) {
 	}
 	return hex.EncodeToString(b), nil
 }
+
+// HashToken returns the hex SHA-256 of a token. Secrets that are handed to
+// clients are stored only in this form so a database leak does not expose them.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// maxUserAgent caps the User-Agent stored with a session.
+const maxUserAgent = 512
+
+// clientInfo returns the User-Agent and IP address to record for a new
+// session.
+func clientInfo(r *http.Request) (userAgent, ip string) {
+	userAgent = r.UserAgent()
+	if len(userAgent) > maxUserAgent {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgent], "")
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return userAgent, ip
+}
+
+// startSession signs the user in on this device. The session the request
+// arrived with, if any, is ended first: a login always gets a fresh token,
+// so a cookie planted before login is worthless (session fixation).
+func startSession(w http.ResponseWriter, r *http.Request, store *Store, cookieDomain, userID string) error {
+	if cookie, err := r.Cookie("session"); err == nil {
+		store.DeleteSession(r.Context(), cookie.Value)
+	}
+	userAgent, ip := clientInfo(r)
+	sess, err := store.CreateSession(r.Context(), userID, userAgent, ip)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, cookieDomain, sess)
+	return nil
+}
+
+// setSessionCookie sets the cookie to last until the session's absolute
+// expiry; the idle timeout is enforced server-side.
+func setSessionCookie(w http.ResponseWriter, cookieDomain string, sess *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    sess.Token,
+		Path:     "/",
+		Domain:   cookieDomain,
+		MaxAge:   int(time.Until(sess.AbsoluteExpiresAt).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
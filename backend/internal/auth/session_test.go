@@ -19,3 +19,17 @@ func TestGenerateToken(t *testing.T) {
 		t.Fatal("two calls produced the same token")
 	}
 }
+
+func TestHashToken(t *testing.T) {
+	tok, _ := GenerateToken()
+	h1 := HashToken(tok)
+	if len(h1) != 64 {
+		t.Fatalf("hash length = %d, want 64", len(h1))
+	}
+	if h1 == tok {
+		t.Fatal("hash should differ from token")
+	}
+	if HashToken(tok) != h1 {
+		t.Fatal("hash should be deterministic")
+	}
+}
@@ -3,34 +3,86 @@ package auth
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
 type User struct {
-	ID           string `json:"id"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"-"`
-	Name         string `json:"name"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID              string     `json:"id"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	PasswordHash    string     `json:"-"`
+	Name            string     `json:"name"`
+	// TwoFactorEnabled is set once TOTP enrollment is confirmed.
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	// DeletionScheduledAt is when the account will be deleted, if the user
+	// has asked for that.
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at"`
+	CreatedAt           time.Time  `json:"created_at"`
 }
 
+// Session is a signed-in browser. Token is the plaintext cookie value; it is
+// only known right after CreateSession or RotateSession, since the table
+// stores its hash. ExpiresAt moves forward while the session is in use, up
+// to AbsoluteExpiresAt.
 type Session struct {
-	Token     string
-	UserID    string
-	ExpiresAt time.Time
+	ID                string    `json:"id"`
+	Token             string    `json:"-"`
+	UserID            string    `json:"-"`
+	UserAgent         string    `json:"user_agent"`
+	IP                string    `json:"ip"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastSeenAt        time.Time `json:"last_seen_at"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	AbsoluteExpiresAt time.Time `json:"absolute_expires_at"`
+}
+
+// AccessToken is a personal access token for the REST API. Scopes is a
+// space-separated list, as in OAuth 2.0.
+type AccessToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     string     `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
 
 type Store struct {
 	DB *sql.DB
+	// SessionLifetime is how long a session lasts from sign-in, however
+	// active. Defaults to 30 days.
+	SessionLifetime time.Duration
+	// SessionIdleTimeout ends a session that goes unused for this long.
+	// Defaults to 7 days.
+	SessionIdleTimeout time.Duration
+}
+
+func (s *Store) sessionLifetime() time.Duration {
+	if s.SessionLifetime > 0 {
+		return s.SessionLifetime
+	}
+	return 30 * 24 * time.Hour
+}
+
+func (s *Store) sessionIdleTimeout() time.Duration {
+	if s.SessionIdleTimeout > 0 {
+		return min(s.SessionIdleTimeout, s.sessionLifetime())
+	}
+	return min(7*24*time.Hour, s.sessionLifetime())
 }
 
 func (s *Store) CreateUser(ctx context.Context, email, passwordHash, name string) (*User, error) {
 	u := &User{}
 	err := s.DB.QueryRowContext(ctx,
 		`INSERT INTO users (email, password_hash, name) VALUES ($1, $2, $3)
-		 RETURNING id, email, password_hash, name, created_at`,
+		 RETURNING id, email, email_verified_at, password_hash, name, totp_enabled_at IS NOT NULL, deletion_scheduled_at, created_at`,
 		email, passwordHash, name,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Name, &u.CreatedAt)
+	).Scan(&u.ID, &u.Email, &u.EmailVerifiedAt, &u.PasswordHash, &u.Name, &u.TwoFactorEnabled, &u.DeletionScheduledAt, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -40,8 +92,9 @@ func (s *Store) CreateUser(ctx context.Context, email, passwordHash, name string
 func (s *Store) UserByEmail(ctx context.Context, email string) (*User, error) {
 	u := &User{}
 	err := s.DB.QueryRowContext(ctx,
-		`SELECT id, email, password_hash, name, created_at FROM users WHERE email=$1`, email,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Name, &u.CreatedAt)
+		`SELECT id, email, email_verified_at, password_hash, name, totp_enabled_at IS NOT NULL, deletion_scheduled_at, created_at
+		 FROM users WHERE email=$1`, email,
+	).Scan(&u.ID, &u.Email, &u.EmailVerifiedAt, &u.PasswordHash, &u.Name, &u.TwoFactorEnabled, &u.DeletionScheduledAt, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -51,68 +104,172 @@ func (s *Store) UserByEmail(ctx context.Context, email string) (*User, error) {
 func (s *Store) UserByID(ctx context.Context, id string) (*User, error) {
 	u := &User{}
 	err := s.DB.QueryRowContext(ctx,
-		`SELECT id, email, password_hash, name, created_at FROM users WHERE id=$1`, id,
-	).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Name, &u.CreatedAt)
+		`SELECT id, email, email_verified_at, password_hash, name, totp_enabled_at IS NOT NULL, deletion_scheduled_at, created_at
+		 FROM users WHERE id=$1`, id,
+	).Scan(&u.ID, &u.Email, &u.EmailVerifiedAt, &u.PasswordHash, &u.Name, &u.TwoFactorEnabled, &u.DeletionScheduledAt, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
-func (s *Store) CreateSession(ctx context.Context, userID string) (*Session, error) {
+// sessionTouchInterval throttles writes of last_seen_at and the sliding
+// expiry, so an active session costs at most one write a minute.
+const sessionTouchInterval = time.Minute
+
+const sessionColumns = `id, user_id, user_agent, ip, created_at, last_seen_at, expires_at, absolute_expires_at`
+
+func scanSession(row interface{ Scan(...any) error }, sess *Session) error {
+	return row.Scan(&sess.ID, &sess.UserID, &sess.UserAgent, &sess.IP, &sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt, &sess.AbsoluteExpiresAt)
+}
+
+// CreateSession starts a session for the user on the device described by
+// userAgent and ip.
+func (s *Store) CreateSession(ctx context.Context, userID, userAgent, ip string) (*Session, error) {
 	token, err := GenerateToken()
 	if err != nil {
 		return nil, err
 	}
-	sess := &Session{
-		Token:     token,
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(30 * 24 * time.Hour),
-	}
-	_, err = s.DB.ExecContext(ctx,
-		`INSERT INTO sessions (token, user_id, expires_at) VALUES ($1, $2, $3)`,
-		sess.Token, sess.UserID, sess.ExpiresAt,
-	)
+	now := time.Now()
+	sess := &Session{Token: token}
+	err = scanSession(s.DB.QueryRowContext(ctx,
+		`INSERT INTO sessions (token_hash, user_id, user_agent, ip, expires_at, absolute_expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING `+sessionColumns,
+		HashToken(token), userID, userAgent, ip, now.Add(s.sessionIdleTimeout()), now.Add(s.sessionLifetime()),
+	), sess)
 	if err != nil {
 		return nil, err
 	}
 	return sess, nil
 }
 
+// SessionByToken looks up a live session and renews it: last_seen_at moves
+// to now and the idle expiry slides forward, capped by the absolute expiry.
+// Renewals are written at most once per sessionTouchInterval.
 func (s *Store) SessionByToken(ctx context.Context, token string) (*Session, error) {
 	sess := &Session{}
-	err := s.DB.QueryRowContext(ctx,
-		`SELECT token, user_id, expires_at FROM sessions WHERE token=$1 AND expires_at > now()`, token,
-	).Scan(&sess.Token, &sess.UserID, &sess.ExpiresAt)
+	err := scanSession(s.DB.QueryRowContext(ctx,
+		`SELECT `+sessionColumns+` FROM sessions
+		 WHERE token_hash=$1 AND expires_at > now() AND absolute_expires_at > now()`, HashToken(token),
+	), sess)
 	if err != nil {
 		return nil, err
 	}
-	return sess, nil
+	if time.Since(sess.LastSeenAt) < sessionTouchInterval {
+		return sess, nil
+	}
+
+	err = scanSession(s.DB.QueryRowContext(ctx,
+		`UPDATE sessions SET last_seen_at=now(), expires_at=LEAST($2, absolute_expires_at)
+		 WHERE id=$1
+		 RETURNING `+sessionColumns,
+		sess.ID, time.Now().Add(s.sessionIdleTimeout()),
+	), sess)
+	return sess, err
+}
+
+// RotateSession replaces the session's token, keeping the session itself.
+// It is called when the user's privileges change, so a token captured
+// before the change stops working.
+func (s *Store) RotateSession(ctx context.Context, sess *Session) error {
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	res, err := s.DB.ExecContext(ctx, `UPDATE sessions SET token_hash=$2 WHERE id=$1`, sess.ID, HashToken(token))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	sess.Token = token
+	return nil
 }
 
 func (s *Store) DeleteSession(ctx context.Context, token string) error {
-	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE token=$1`, token)
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash=$1`, HashToken(token))
 	return err
 }
 
-func (s *Store) FindOrCreateOAuthUser(ctx context.Context, provider, providerID, email, name string) (*User, error) {
+// ListSessions returns the user's live sessions, most recently seen first.
+func (s *Store) ListSessions(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT `+sessionColumns+` FROM sessions
+		 WHERE user_id=$1 AND expires_at > now() AND absolute_expires_at > now()
+		 ORDER BY last_seen_at DESC`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := scanSession(rows, &sess); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes one of the user's sessions by ID.
+func (s *Store) RevokeSession(ctx context.Context, id, userID string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE id=$1 AND user_id=$2`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeOtherSessions deletes all of the user's sessions except keepID
+// (which may be empty) and returns how many were deleted.
+func (s *Store) RevokeOtherSessions(ctx context.Context, userID, keepID string) (int64, error) {
+	res, err := s.DB.ExecContext(ctx,
+		`DELETE FROM sessions WHERE user_id=$1 AND id::text <> $2`, userID, keepID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ErrEmailNotVerified is returned when an OAuth identity would be linked to
+// an existing account by email, but either side hasn't verified the address.
+var ErrEmailNotVerified = errors.New("email not verified")
+
+// FindOrCreateOAuthUser signs in an OAuth identity. emailVerified reports
+// whether the provider vouches for the address.
+func (s *Store) FindOrCreateOAuthUser(ctx context.Context, provider, providerID, email, name string, emailVerified bool) (*User, error) {
 	// Try to find by provider+providerID
 	var userID string
 	err := s.DB.QueryRowContext(ctx,
-		`SELECT user_id FROM oauth_accounts WHERE provider=$1 AND provider_id=$2`,
-		provider, providerID,
+		`UPDATE oauth_accounts SET email=$3 WHERE provider=$1 AND provider_id=$2 RETURNING user_id`,
+		provider, providerID, email,
 	).Scan(&userID)
 	if err == nil {
 		return s.UserByID(ctx, userID)
 	}
 
-	// Try to find by email
+	// Try to find by email. Only link when both sides proved they own the
+	// address; otherwise whoever registered it first could take over the
+	// other identity.
 	u, err := s.UserByEmail(ctx, email)
 	if err == nil {
+		if u.EmailVerifiedAt == nil || !emailVerified {
+			return nil, ErrEmailNotVerified
+		}
 		// Link OAuth account
 		_, err = s.DB.ExecContext(ctx,
-			`INSERT INTO oauth_accounts (user_id, provider, provider_id) VALUES ($1, $2, $3)`,
-			u.ID, provider, providerID,
+			`INSERT INTO oauth_accounts (user_id, provider, provider_id, email) VALUES ($1, $2, $3, $4)`,
+			u.ID, provider, providerID, email,
 		)
 		return u, err
 	}
@@ -123,11 +280,855 @@ func (s *Store) FindOrCreateOAuthUser(ctx context.Context, provider, providerID,
 		return nil, err
 	}
 	_, err = s.DB.ExecContext(ctx,
-		`INSERT INTO oauth_accounts (user_id, provider, provider_id) VALUES ($1, $2, $3)`,
-		u.ID, provider, providerID,
+		`INSERT INTO oauth_accounts (user_id, provider, provider_id, email) VALUES ($1, $2, $3, $4)`,
+		u.ID, provider, providerID, email,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if emailVerified {
+		if err := s.MarkEmailVerified(ctx, u.ID); err != nil {
+			return nil, err
+		}
+		return s.UserByID(ctx, u.ID)
+	}
 	return u, nil
 }
+
+// OAuthIdentity is a provider account linked to a user.
+type OAuthIdentity struct {
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	// ErrIdentityLinked is returned when linking a provider account that
+	// already belongs to another user.
+	ErrIdentityLinked = errors.New("this account is already linked to another user")
+	// ErrLastLoginMethod is returned when unlinking would leave the user
+	// with no way to sign in.
+	ErrLastLoginMethod = errors.New("cannot unlink the only sign-in method; set a password first")
+)
+
+// ListOAuthIdentities returns the provider accounts linked to the user,
+// oldest first.
+func (s *Store) ListOAuthIdentities(ctx context.Context, userID string) ([]OAuthIdentity, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, provider, email, created_at FROM oauth_accounts
+		 WHERE user_id=$1 ORDER BY created_at`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []OAuthIdentity{}
+	for rows.Next() {
+		var i OAuthIdentity
+		if err := rows.Scan(&i.ID, &i.Provider, &i.Email, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// LinkOAuthIdentity attaches a provider account to the user. Linking one
+// that is already the user's is a no-op.
+func (s *Store) LinkOAuthIdentity(ctx context.Context, userID, provider, providerID, email string) error {
+	var owner string
+	err := s.DB.QueryRowContext(ctx,
+		`INSERT INTO oauth_accounts (user_id, provider, provider_id, email) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (provider, provider_id) DO UPDATE SET email = EXCLUDED.email
+		 RETURNING user_id`,
+		userID, provider, providerID, email,
+	).Scan(&owner)
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		return ErrIdentityLinked
+	}
+	return nil
+}
+
+// UnlinkOAuthIdentity removes one of the user's linked provider accounts.
+// A user without a password must keep at least one.
+func (s *Store) UnlinkOAuthIdentity(ctx context.Context, userID, id string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the user serializes concurrent unlinks, which could otherwise
+	// each see another identity left.
+	var hasPassword bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(password_hash, '') <> '' FROM users WHERE id=$1 FOR UPDATE`, userID,
+	).Scan(&hasPassword)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM oauth_accounts WHERE id=$1 AND user_id=$2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if !hasPassword {
+		var left int
+		if err := tx.QueryRowContext(ctx,
+			`SELECT count(*) FROM oauth_accounts WHERE user_id=$1`, userID,
+		).Scan(&left); err != nil {
+			return err
+		}
+		if left == 0 {
+			return ErrLastLoginMethod
+		}
+	}
+	return tx.Commit()
+}
+
+// MarkEmailVerified records that the user controls their current address.
+func (s *Store) MarkEmailVerified(ctx context.Context, userID string) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id=$1`, userID,
+	)
+	return err
+}
+
+// accessTokenPrefix marks personal access tokens so they are recognizable
+// in logs and by secret scanners.
+const accessTokenPrefix = "fbp_"
+
+// CreateAccessToken stores a new token and returns its plaintext value,
+// which is not recoverable afterwards.
+func (s *Store) CreateAccessToken(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (string, *AccessToken, error) {
+	raw, err := GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	token := accessTokenPrefix + raw
+
+	t := &AccessToken{}
+	err = s.DB.QueryRowContext(ctx,
+		`INSERT INTO access_tokens (user_id, name, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id, user_id, name, scopes, expires_at, last_used_at, created_at`,
+		userID, name, HashToken(token), strings.Join(scopes, " "), expiresAt,
+	).Scan(&t.ID, &t.UserID, &t.Name, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+func (s *Store) ListAccessTokens(ctx context.Context, userID string) ([]AccessToken, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+		 FROM access_tokens WHERE user_id=$1 ORDER BY created_at DESC`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []AccessToken{}
+	for rows.Next() {
+		var t AccessToken
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *Store) DeleteAccessToken(ctx context.Context, id, userID string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM access_tokens WHERE id=$1 AND user_id=$2`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AccessTokenByValue looks up an unexpired token and records its use.
+// last_used_at is written at most once a minute per token.
+func (s *Store) AccessTokenByValue(ctx context.Context, token string) (*AccessToken, error) {
+	t := &AccessToken{}
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+		 FROM access_tokens WHERE token_hash=$1 AND (expires_at IS NULL OR expires_at > now())`,
+		HashToken(token),
+	).Scan(&t.ID, &t.UserID, &t.Name, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		`UPDATE access_tokens SET last_used_at=now()
+		 WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')`,
+		t.ID,
+	)
+	return t, err
+}
+
+// Password reset
+
+// ErrInvalidToken is returned for unknown, expired or already used
+// one-time tokens.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// CreatePasswordResetToken stores a single-use reset token valid for ttl and
+// returns its plaintext value.
+func (s *Store) CreatePasswordResetToken(ctx context.Context, userID string, ttl time.Duration) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		`INSERT INTO password_reset_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, HashToken(token), time.Now().Add(ttl),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ResetPassword consumes a reset token and sets the user's password. All of
+// the user's outstanding reset tokens and sessions are revoked with it.
+func (s *Store) ResetPassword(ctx context.Context, token, passwordHash string) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx,
+		`SELECT user_id FROM password_reset_tokens
+		 WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()
+		 FOR UPDATE`,
+		HashToken(token),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Following the emailed link also proves the user owns the address.
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET password_hash=$2, email_verified_at = COALESCE(email_verified_at, now()) WHERE id=$1`,
+		userID, passwordHash,
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL`, userID,
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id=$1`, userID); err != nil {
+		return "", err
+	}
+	// Proving control of the mailbox lifts a login lockout on the account.
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM login_failures
+		 WHERE scope=$2 AND subject = (SELECT lower(email) FROM users WHERE id=$1)`,
+		userID, LoginScopeAccount,
+	); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+// Login failures
+
+// Scopes of login failure records. An account is identified by its
+// lowercased email, whether or not a user has it, so lockouts don't reveal
+// which accounts exist. Password reset requests are counted the same way in
+// scopes of their own, so they never lock out logins.
+const (
+	LoginScopeIP           = "ip"
+	LoginScopeAccount      = "account"
+	LoginScopeResetIP      = "reset_ip"
+	LoginScopeResetAccount = "reset_account"
+)
+
+// LoginLockedUntil returns when the lockout on the client IP or the account
+// ends, whichever is later, or the zero time if neither is locked.
+func (s *Store) LoginLockedUntil(ctx context.Context, ip, account string) (time.Time, error) {
+	return s.lockedUntil(ctx, LoginScopeIP, ip, LoginScopeAccount, account)
+}
+
+// PasswordResetLockedUntil is LoginLockedUntil for password reset requests.
+func (s *Store) PasswordResetLockedUntil(ctx context.Context, ip, account string) (time.Time, error) {
+	return s.lockedUntil(ctx, LoginScopeResetIP, ip, LoginScopeResetAccount, account)
+}
+
+func (s *Store) lockedUntil(ctx context.Context, ipScope, ip, accountScope, account string) (time.Time, error) {
+	var until sql.NullTime
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT max(locked_until) FROM login_failures
+		 WHERE locked_until > now()
+		   AND ((scope=$1 AND subject=$2) OR (scope=$3 AND subject=$4))`,
+		ipScope, ip, accountScope, account,
+	).Scan(&until)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return until.Time, nil
+}
+
+// RecordLoginFailure counts a failed login against subject and returns the
+// number of failures so far. Failures before since are forgotten.
+func (s *Store) RecordLoginFailure(ctx context.Context, scope, subject string, since time.Time) (int, error) {
+	var failures int
+	err := s.DB.QueryRowContext(ctx,
+		`INSERT INTO login_failures (scope, subject, failures, last_failure_at)
+		 VALUES ($1, $2, 1, now())
+		 ON CONFLICT (scope, subject) DO UPDATE SET
+		   failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1
+		                   ELSE login_failures.failures + 1 END,
+		   last_failure_at = now()
+		 RETURNING failures`,
+		scope, subject, since,
+	).Scan(&failures)
+	return failures, err
+}
+
+// LockLogin refuses logins for subject until the given time.
+func (s *Store) LockLogin(ctx context.Context, scope, subject string, until time.Time) error {
+	_, err := s.DB.ExecContext(ctx,
+		`UPDATE login_failures SET locked_until=$3 WHERE scope=$1 AND subject=$2`,
+		scope, subject, until,
+	)
+	return err
+}
+
+// ClearLoginFailures forgets subject's failed logins and any lockout.
+func (s *Store) ClearLoginFailures(ctx context.Context, scope, subject string) error {
+	_, err := s.DB.ExecContext(ctx,
+		`DELETE FROM login_failures WHERE scope=$1 AND subject=$2`, scope, subject)
+	return err
+}
+
+// Email verification
+
+// CreateEmailVerificationToken stores a token that verifies email for the
+// user when used within ttl, and returns its plaintext value.
+func (s *Store) CreateEmailVerificationToken(ctx context.Context, userID, email string, ttl time.Duration) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		`INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, email, HashToken(token), time.Now().Add(ttl),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// VerifyEmail consumes a verification token and marks the user's address
+// verified. Tokens sent to an address the user no longer has are invalid.
+func (s *Store) VerifyEmail(ctx context.Context, token string) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx,
+		`SELECT t.user_id FROM email_verification_tokens t
+		 JOIN users u ON u.id = t.user_id AND u.email = t.email
+		 WHERE t.token_hash=$1 AND t.expires_at > now()
+		 FOR UPDATE OF t`,
+		HashToken(token),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id=$1`, userID,
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_verification_tokens WHERE user_id=$1`, userID); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+// Password and email changes
+
+// ErrEmailTaken is returned when changing to an address another account has.
+var ErrEmailTaken = errors.New("email already registered")
+
+// SetPassword replaces the user's password (or adds one to an OAuth-only
+// account) and signs out every session except keepSessionID.
+func (s *Store) SetPassword(ctx context.Context, userID, passwordHash, keepSessionID string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET password_hash=$2 WHERE id=$1`, userID, passwordHash,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM sessions WHERE user_id=$1 AND id::text <> $2`, userID, keepSessionID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEmailChange stores a request to change the user's address to
+// newEmail, confirmed by the returned token within ttl. It replaces any
+// earlier request.
+func (s *Store) CreateEmailChange(ctx context.Context, userID, newEmail string, ttl time.Duration) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)`, newEmail,
+	).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrEmailTaken
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id=$1`, userID); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO email_changes (user_id, new_email, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, newEmail, HashToken(token), time.Now().Add(ttl),
+	); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// ConfirmEmailChange consumes an email change token and switches the user
+// to the new, now verified, address. It returns the user's ID.
+func (s *Store) ConfirmEmailChange(ctx context.Context, token string) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID, newEmail string
+	err = tx.QueryRowContext(ctx,
+		`SELECT user_id, new_email FROM email_changes
+		 WHERE token_hash=$1 AND expires_at > now()
+		 FOR UPDATE`,
+		HashToken(token),
+	).Scan(&userID, &newEmail)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Someone may have registered the address since the change was asked for.
+	var taken bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE email=$1 AND id <> $2)`, newEmail, userID,
+	).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrEmailTaken
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET email=$2, email_verified_at=now() WHERE id=$1`, userID, newEmail,
+	); err != nil {
+		return "", err
+	}
+	// Links for the old address must not verify it again, and reset links
+	// already sent there must not take over the account.
+	for _, q := range []string{
+		`DELETE FROM email_changes WHERE user_id=$1`,
+		`DELETE FROM email_verification_tokens WHERE user_id=$1`,
+		`UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+			return "", err
+		}
+	}
+	return userID, tx.Commit()
+}
+
+// Account deletion
+
+// ErrDeletionScheduled is returned when asking to delete an account that is
+// already due to be deleted.
+var ErrDeletionScheduled = errors.New("account deletion already scheduled")
+
+// ScheduleAccountDeletion marks the user's account for deletion at the
+// given time and records the request in account_deletions.
+func (s *Store) ScheduleAccountDeletion(ctx context.Context, userID string, at time.Time) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET deletion_scheduled_at=$2 WHERE id=$1 AND deletion_scheduled_at IS NULL`, userID, at,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeletionScheduled
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO account_deletions (user_id, scheduled_at) VALUES ($1, $2)`, userID, at,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelAccountDeletion keeps an account that was due to be deleted. It
+// returns sql.ErrNoRows if no deletion was scheduled.
+func (s *Store) CancelAccountDeletion(ctx context.Context, userID string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE users SET deletion_scheduled_at=NULL WHERE id=$1 AND deletion_scheduled_at IS NOT NULL`, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE account_deletions SET cancelled_at=now()
+		 WHERE user_id=$1 AND cancelled_at IS NULL AND completed_at IS NULL`, userID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DueAccountDeletions returns the IDs of accounts whose grace period is over.
+func (s *Store) DueAccountDeletions(ctx context.Context) ([]string, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id FROM users WHERE deletion_scheduled_at <= now() ORDER BY deletion_scheduled_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteAccount deletes a user whose grace period is over. Sessions,
+// tokens, linked identities and owned boards (with their cards and
+// webhooks) cascade from the users row. It returns the address the account
+// had and how many boards went with it, or sql.ErrNoRows if the account is
+// not due, e.g. because the deletion was cancelled in the meantime.
+func (s *Store) DeleteAccount(ctx context.Context, userID string) (string, int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRowContext(ctx,
+		`SELECT email FROM users WHERE id=$1 AND deletion_scheduled_at <= now() FOR UPDATE`, userID,
+	).Scan(&email)
+	if err != nil {
+		return "", 0, err
+	}
+	var boards int
+	if err := tx.QueryRowContext(ctx,
+		`SELECT count(*) FROM boards WHERE user_id=$1`, userID,
+	).Scan(&boards); err != nil {
+		return "", 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM login_failures WHERE scope=$2 AND subject=lower($1)`, email, LoginScopeAccount,
+	); err != nil {
+		return "", 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id=$1`, userID); err != nil {
+		return "", 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE account_deletions SET completed_at=now(), boards_deleted=$2
+		 WHERE user_id=$1 AND cancelled_at IS NULL AND completed_at IS NULL`, userID, boards,
+	); err != nil {
+		return "", 0, err
+	}
+	return email, boards, tx.Commit()
+}
+
+// Data export
+
+// ExportFile is one file of an account export: the user's rows from one
+// table as a JSON array.
+type ExportFile struct {
+	Name string
+	Data json.RawMessage
+}
+
+// exportTables is what an account export contains. query selects the
+// user's rows ($1 is the user ID); the columns in omit (hashes and secrets)
+// are left out, and rows are ordered by orderBy.
+//
+// Left out on purpose: login failures counted against an IP address, which
+// can't be tied to one user, and the bodies of queued mail, which carry
+// live sign-in and verification links.
+var exportTables = []struct {
+	name, query, omit, orderBy string
+}{
+	{"account", `SELECT * FROM users WHERE id=$1`, "password_hash,totp_secret,totp_last_step", "created_at"},
+	{"sessions", `SELECT * FROM sessions WHERE user_id=$1`, "token_hash", "created_at"},
+	{"oauth_accounts", `SELECT * FROM oauth_accounts WHERE user_id=$1`, "", "created_at"},
+	{"access_tokens", `SELECT * FROM access_tokens WHERE user_id=$1`, "token_hash", "created_at"},
+	{"feed_tokens", `SELECT * FROM feed_tokens WHERE user_id=$1`, "token_hash", "created_at"},
+	{"recovery_codes", `SELECT * FROM recovery_codes WHERE user_id=$1`, "code_hash", "created_at"},
+	{"login_challenges", `SELECT * FROM login_challenges WHERE user_id=$1`, "token_hash", "created_at"},
+	{"password_reset_tokens", `SELECT * FROM password_reset_tokens WHERE user_id=$1`, "token_hash", "created_at"},
+	{"email_verification_tokens", `SELECT * FROM email_verification_tokens WHERE user_id=$1`, "token_hash", "created_at"},
+	{"email_changes", `SELECT * FROM email_changes WHERE user_id=$1`, "token_hash", "created_at"},
+	{"login_failures", `SELECT * FROM login_failures
+		WHERE scope IN ('account', 'reset_account') AND subject=(SELECT lower(email) FROM users WHERE id=$1)`, "", "last_failure_at"},
+	{"account_deletions", `SELECT * FROM account_deletions WHERE user_id=$1`, "", "requested_at"},
+	{"jobs", `SELECT j.id, j.kind, j.status, j.attempts, j.max_attempts, j.run_at, j.last_error, j.redacted_at, j.created_at,
+			j.payload->>'to' AS mail_to, j.payload->>'subject' AS mail_subject
+		FROM jobs j JOIN users u ON u.id=$1
+		WHERE (j.kind='mail.send' AND lower(j.payload->>'to') = lower(u.email))
+		   OR (j.kind='auth.password_reset' AND lower(j.payload #>> '{}') = lower(u.email))`, "", "created_at"},
+	{"boards", `SELECT * FROM boards WHERE user_id=$1`, "", "created_at"},
+	{"board_columns", `SELECT c.* FROM board_columns c
+		JOIN boards b ON b.id = c.board_id WHERE b.user_id=$1`, "", "created_at"},
+	{"cards", `SELECT k.* FROM cards k
+		JOIN board_columns c ON c.id = k.column_id
+		JOIN boards b ON b.id = c.board_id WHERE b.user_id=$1`, "", "created_at"},
+	{"card_activity", `SELECT a.* FROM card_activity a
+		JOIN boards b ON b.id = a.board_id WHERE b.user_id=$1`, "", "created_at"},
+	{"webhooks", `SELECT w.* FROM webhooks w
+		JOIN boards b ON b.id = w.board_id WHERE b.user_id=$1`, "secret", "created_at"},
+	{"webhook_deliveries", `SELECT d.* FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		JOIN boards b ON b.id = w.board_id WHERE b.user_id=$1`, "", "created_at"},
+	{"webhook_delivery_attempts", `SELECT a.* FROM webhook_delivery_attempts a
+		JOIN webhook_deliveries d ON d.id = a.delivery_id
+		JOIN webhooks w ON w.id = d.webhook_id
+		JOIN boards b ON b.id = w.board_id WHERE b.user_id=$1`, "", "created_at"},
+}
+
+// ExportAccount returns every row tied to the user, one file per table,
+// read from a single snapshot so the files agree with each other.
+func (s *Store) ExportAccount(ctx context.Context, userID string) ([]ExportFile, error) {
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	files := make([]ExportFile, 0, len(exportTables))
+	for _, t := range exportTables {
+		q := `SELECT COALESCE(jsonb_agg(to_jsonb(t) - '{` + t.omit + `}'::text[] ORDER BY t.` + t.orderBy + `), '[]')
+		      FROM (` + t.query + `) t`
+		var data []byte
+		if err := tx.QueryRowContext(ctx, q, userID).Scan(&data); err != nil {
+			return nil, fmt.Errorf("export %s: %w", t.name, err)
+		}
+		files = append(files, ExportFile{Name: t.name + ".json", Data: data})
+	}
+	return files, tx.Commit()
+}
+
+// Two-factor authentication
+
+// ErrTwoFactorEnabled is returned when starting TOTP enrollment for a user
+// who already has it on.
+var ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+
+// SetPendingTOTPSecret starts (or restarts) enrollment. The secret only
+// takes effect once EnableTwoFactor confirms it.
+func (s *Store) SetPendingTOTPSecret(ctx context.Context, userID, secret string) error {
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET totp_secret=$2 WHERE id=$1 AND totp_enabled_at IS NULL`, userID, secret,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// TOTPSecret returns the user's TOTP secret (empty if enrollment never
+// started) and whether 2FA is enabled.
+func (s *Store) TOTPSecret(ctx context.Context, userID string) (string, bool, error) {
+	var secret string
+	var enabled bool
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT totp_secret, totp_enabled_at IS NOT NULL FROM users WHERE id=$1`, userID,
+	).Scan(&secret, &enabled)
+	return secret, enabled, err
+}
+
+// UseTOTPStep records that a code from step was accepted. It reports false
+// if a code from that step or a later one was already used.
+func (s *Store) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE users SET totp_last_step=$2 WHERE id=$1 AND totp_last_step < $2`, userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// EnableTwoFactor turns on 2FA with the pending secret and replaces the
+// user's recovery codes.
+func (s *Store) EnableTwoFactor(ctx context.Context, userID string, recoveryCodes []string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET totp_enabled_at=now() WHERE id=$1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, HashToken(normalizeRecoveryCode(code)),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) DisableTwoFactor(ctx context.Context, userID string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE users SET totp_secret='', totp_enabled_at=NULL, totp_last_step=0 WHERE id=$1`, userID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes. It
+// reports whether code was valid.
+func (s *Store) UseRecoveryCode(ctx context.Context, userID, code string) (bool, error) {
+	res, err := s.DB.ExecContext(ctx,
+		`UPDATE recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`,
+		userID, HashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// CreateLoginChallenge issues the token that stands in for a session
+// between the password and the second factor.
+func (s *Store) CreateLoginChallenge(ctx context.Context, userID string, ttl time.Duration) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		`INSERT INTO login_challenges (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, HashToken(token), time.Now().Add(ttl),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AttemptLoginChallenge counts an attempt against a live challenge and
+// returns its user. A challenge allows at most maxAttempts attempts.
+func (s *Store) AttemptLoginChallenge(ctx context.Context, token string, maxAttempts int) (string, error) {
+	var userID string
+	err := s.DB.QueryRowContext(ctx,
+		`UPDATE login_challenges SET attempts = attempts + 1
+		 WHERE token_hash=$1 AND expires_at > now() AND attempts < $2
+		 RETURNING user_id`,
+		HashToken(token), maxAttempts,
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidToken
+	}
+	return userID, err
+}
+
+func (s *Store) DeleteLoginChallenge(ctx context.Context, token string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM login_challenges WHERE token_hash=$1`, HashToken(token))
+	return err
+}
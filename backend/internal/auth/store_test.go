@@ -3,7 +3,9 @@ package auth
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"trello-clone/internal/testutil"
 )
@@ -93,7 +95,7 @@ func TestCreateSession(t *testing.T) {
 	ctx := context.Background()
 
 	u, _ := s.CreateUser(ctx, "sess@example.com", "hash", "Sess")
-	sess, err := s.CreateSession(ctx, u.ID)
+	sess, err := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
@@ -111,7 +113,7 @@ func TestSessionByToken(t *testing.T) {
 	ctx := context.Background()
 
 	u, _ := s.CreateUser(ctx, "tok@example.com", "hash", "Tok")
-	created, _ := s.CreateSession(ctx, u.ID)
+	created, _ := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
 
 	found, err := s.SessionByToken(ctx, created.Token)
 	if err != nil {
@@ -128,12 +130,12 @@ func TestSessionByTokenExpired(t *testing.T) {
 	ctx := context.Background()
 
 	u, _ := s.CreateUser(ctx, "exp@example.com", "hash", "Exp")
-	sess, _ := s.CreateSession(ctx, u.ID)
+	sess, _ := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
 
 	// Manually expire the session
 	_, err := db.ExecContext(ctx,
-		"UPDATE sessions SET expires_at = now() - interval '1 hour' WHERE token=$1",
-		sess.Token,
+		"UPDATE sessions SET expires_at = now() - interval '1 hour' WHERE id=$1",
+		sess.ID,
 	)
 	if err != nil {
 		t.Fatalf("expire session: %v", err)
@@ -151,7 +153,7 @@ func TestDeleteSession(t *testing.T) {
 	ctx := context.Background()
 
 	u, _ := s.CreateUser(ctx, "del@example.com", "hash", "Del")
-	sess, _ := s.CreateSession(ctx, u.ID)
+	sess, _ := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
 
 	if err := s.DeleteSession(ctx, sess.Token); err != nil {
 		t.Fatalf("delete session: %v", err)
@@ -163,12 +165,137 @@ func TestDeleteSession(t *testing.T) {
 	}
 }
 
+func TestSessionTokenStoredHashed(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	ctx := context.Background()
+
+	u, _ := s.CreateUser(ctx, "hashed@example.com", "hash", "Hashed")
+	sess, _ := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
+
+	var stored string
+	db.QueryRowContext(ctx, "SELECT token_hash FROM sessions WHERE id=$1", sess.ID).Scan(&stored)
+	if stored == sess.Token || stored != HashToken(sess.Token) {
+		t.Fatalf("stored %q, want hash of the token", stored)
+	}
+	if sess.UserAgent != "test-agent" || sess.IP != "127.0.0.1" {
+		t.Fatalf("session = %+v", sess)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	ctx := context.Background()
+
+	u, _ := s.CreateUser(ctx, "devices@example.com", "hash", "Devices")
+	other, _ := s.CreateUser(ctx, "other@example.com", "hash", "Other")
+	laptop, _ := s.CreateSession(ctx, u.ID, "laptop", "10.0.0.1")
+	phone, _ := s.CreateSession(ctx, u.ID, "phone", "10.0.0.2")
+	tablet, _ := s.CreateSession(ctx, u.ID, "tablet", "10.0.0.3")
+	s.CreateSession(ctx, other.ID, "elsewhere", "10.0.0.4")
+
+	sessions, err := s.ListSessions(ctx, u.ID)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("sessions = %d, want 3", len(sessions))
+	}
+
+	if err := s.RevokeSession(ctx, phone.ID, other.ID); err != sql.ErrNoRows {
+		t.Fatalf("revoking another user's session: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := s.RevokeSession(ctx, phone.ID, u.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := s.SessionByToken(ctx, phone.Token); err == nil {
+		t.Fatal("revoked session still valid")
+	}
+
+	n, err := s.RevokeOtherSessions(ctx, u.ID, laptop.ID)
+	if err != nil || n != 1 {
+		t.Fatalf("revoke others = %d, %v; want 1", n, err)
+	}
+	if _, err := s.SessionByToken(ctx, tablet.Token); err == nil {
+		t.Fatal("tablet session still valid")
+	}
+	if _, err := s.SessionByToken(ctx, laptop.Token); err != nil {
+		t.Fatalf("kept session revoked: %v", err)
+	}
+	if others, _ := s.ListSessions(ctx, other.ID); len(others) != 1 {
+		t.Fatal("other user's sessions should be untouched")
+	}
+}
+
+func TestSessionSlidingExpiry(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db, SessionLifetime: 24 * time.Hour, SessionIdleTimeout: time.Hour}
+	ctx := context.Background()
+
+	u, _ := s.CreateUser(ctx, "sliding@example.com", "hash", "Sliding")
+	sess, _ := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
+	if d := time.Until(sess.ExpiresAt); d > time.Hour || d < 59*time.Minute {
+		t.Fatalf("idle expiry in %s, want about 1h", d)
+	}
+	if d := time.Until(sess.AbsoluteExpiresAt); d > 24*time.Hour || d < 23*time.Hour {
+		t.Fatalf("absolute expiry in %s, want about 24h", d)
+	}
+
+	// Used 30 minutes ago: the lookup renews the idle expiry.
+	db.ExecContext(ctx, "UPDATE sessions SET last_seen_at = now() - interval '30 minutes', expires_at = now() + interval '30 minutes' WHERE id=$1", sess.ID)
+	renewed, err := s.SessionByToken(ctx, sess.Token)
+	if err != nil {
+		t.Fatalf("session by token: %v", err)
+	}
+	if d := time.Until(renewed.ExpiresAt); d < 59*time.Minute {
+		t.Fatalf("renewed expiry in %s, want about 1h", d)
+	}
+
+	// Renewal never passes the absolute expiry.
+	db.ExecContext(ctx, "UPDATE sessions SET last_seen_at = now() - interval '5 minutes', absolute_expires_at = now() + interval '10 minutes' WHERE id=$1", sess.ID)
+	capped, _ := s.SessionByToken(ctx, sess.Token)
+	if !capped.ExpiresAt.Equal(capped.AbsoluteExpiresAt) {
+		t.Fatalf("expires_at = %s, want capped at %s", capped.ExpiresAt, capped.AbsoluteExpiresAt)
+	}
+
+	// Idle for too long.
+	db.ExecContext(ctx, "UPDATE sessions SET expires_at = now() - interval '1 second' WHERE id=$1", sess.ID)
+	if _, err := s.SessionByToken(ctx, sess.Token); err == nil {
+		t.Fatal("idle session should have expired")
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	ctx := context.Background()
+
+	u, _ := s.CreateUser(ctx, "rotate@example.com", "hash", "Rotate")
+	sess, _ := s.CreateSession(ctx, u.ID, "test-agent", "127.0.0.1")
+	oldToken := sess.Token
+
+	if err := s.RotateSession(ctx, sess); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if sess.Token == oldToken {
+		t.Fatal("token should change")
+	}
+	if _, err := s.SessionByToken(ctx, oldToken); err == nil {
+		t.Fatal("old token should stop working")
+	}
+	found, err := s.SessionByToken(ctx, sess.Token)
+	if err != nil || found.ID != sess.ID {
+		t.Fatalf("new token: %v, %+v", err, found)
+	}
+}
+
 func TestFindOrCreateOAuthUser_New(t *testing.T) {
 	db := testutil.SetupDB(t)
 	s := &Store{DB: db}
 	ctx := context.Background()
 
-	u, err := s.FindOrCreateOAuthUser(ctx, "google", "gid123", "oauth@example.com", "OAuth User")
+	u, err := s.FindOrCreateOAuthUser(ctx, "google", "gid123", "oauth@example.com", "OAuth User", true)
 	if err != nil {
 		t.Fatalf("find or create: %v", err)
 	}
@@ -178,6 +305,9 @@ func TestFindOrCreateOAuthUser_New(t *testing.T) {
 	if u.Name != "OAuth User" {
 		t.Fatalf("name = %q, want OAuth User", u.Name)
 	}
+	if u.EmailVerifiedAt == nil {
+		t.Fatal("email from a verifying provider should be marked verified")
+	}
 
 	// Verify oauth_account was created
 	var count int
@@ -197,8 +327,8 @@ func TestFindOrCreateOAuthUser_ExistingProvider(t *testing.T) {
 	s := &Store{DB: db}
 	ctx := context.Background()
 
-	u1, _ := s.FindOrCreateOAuthUser(ctx, "google", "gid456", "existing@example.com", "First")
-	u2, err := s.FindOrCreateOAuthUser(ctx, "google", "gid456", "existing@example.com", "Second")
+	u1, _ := s.FindOrCreateOAuthUser(ctx, "google", "gid456", "existing@example.com", "First", true)
+	u2, err := s.FindOrCreateOAuthUser(ctx, "google", "gid456", "existing@example.com", "Second", true)
 	if err != nil {
 		t.Fatalf("second call: %v", err)
 	}
@@ -212,11 +342,12 @@ func TestFindOrCreateOAuthUser_ExistingEmail(t *testing.T) {
 	s := &Store{DB: db}
 	ctx := context.Background()
 
-	// Create a regular user first
+	// Create a regular user with a verified email first
 	existing, _ := s.CreateUser(ctx, "link@example.com", "hash", "Link")
+	s.MarkEmailVerified(ctx, existing.ID)
 
-	// OAuth with same email should link, not create new user
-	u, err := s.FindOrCreateOAuthUser(ctx, "microsoft", "msid789", "link@example.com", "Link MS")
+	// OAuth with same verified email should link, not create new user
+	u, err := s.FindOrCreateOAuthUser(ctx, "google", "gid789", "link@example.com", "Link Google", true)
 	if err != nil {
 		t.Fatalf("find or create: %v", err)
 	}
@@ -227,7 +358,7 @@ func TestFindOrCreateOAuthUser_ExistingEmail(t *testing.T) {
 	// Verify oauth_account was linked
 	var linkedUserID string
 	err = db.QueryRowContext(ctx,
-		"SELECT user_id FROM oauth_accounts WHERE provider='microsoft' AND provider_id='msid789'",
+		"SELECT user_id FROM oauth_accounts WHERE provider='google' AND provider_id='gid789'",
 	).Scan(&linkedUserID)
 	if err != nil {
 		t.Fatalf("query: %v", err)
@@ -237,6 +368,30 @@ func TestFindOrCreateOAuthUser_ExistingEmail(t *testing.T) {
 	}
 }
 
+func TestFindOrCreateOAuthUser_UnverifiedEmail(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	ctx := context.Background()
+
+	// A password account nobody has verified must not be linked...
+	unverified, _ := s.CreateUser(ctx, "squat@example.com", "hash", "Squatter")
+	if _, err := s.FindOrCreateOAuthUser(ctx, "google", "gid1", "squat@example.com", "Owner", true); err != ErrEmailNotVerified {
+		t.Fatalf("err = %v, want ErrEmailNotVerified", err)
+	}
+
+	// ...and neither may an address the provider doesn't vouch for.
+	s.MarkEmailVerified(ctx, unverified.ID)
+	if _, err := s.FindOrCreateOAuthUser(ctx, "microsoft", "msid1", "squat@example.com", "Owner", false); err != ErrEmailNotVerified {
+		t.Fatalf("err = %v, want ErrEmailNotVerified", err)
+	}
+
+	var count int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM oauth_accounts").Scan(&count)
+	if count != 0 {
+		t.Fatalf("oauth_accounts count = %d, want 0", count)
+	}
+}
+
 // helper to create a user for tests that need one
 func createTestUser(t *testing.T, db *sql.DB, email string) *User {
 	t.Helper()
@@ -248,3 +403,86 @@ func createTestUser(t *testing.T, db *sql.DB, email string) *User {
 	}
 	return u
 }
+
+func TestAccessTokens(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	ctx := context.Background()
+
+	u := createTestUser(t, db, "pat@example.com")
+	token, created, err := s.CreateAccessToken(ctx, u.ID, "script", []string{ScopeBoardsRead, ScopeBoardsWrite}, nil)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	if created.Scopes != "boards:read boards:write" {
+		t.Fatalf("scopes = %q", created.Scopes)
+	}
+
+	// Only the hash is stored.
+	var stored string
+	db.QueryRowContext(ctx, "SELECT token_hash FROM access_tokens WHERE id=$1", created.ID).Scan(&stored)
+	if stored == token || stored != HashToken(token) {
+		t.Fatalf("stored token_hash = %q, want hash of token", stored)
+	}
+
+	found, err := s.AccessTokenByValue(ctx, token)
+	if err != nil {
+		t.Fatalf("token by value: %v", err)
+	}
+	if found.ID != created.ID {
+		t.Fatalf("ID = %s, want %s", found.ID, created.ID)
+	}
+
+	tokens, _ := s.ListAccessTokens(ctx, u.ID)
+	if len(tokens) != 1 {
+		t.Fatalf("tokens = %d, want 1", len(tokens))
+	}
+	if tokens[0].LastUsedAt == nil {
+		t.Fatal("expected last_used_at to be recorded")
+	}
+
+	if err := s.DeleteAccessToken(ctx, created.ID, u.ID); err != nil {
+		t.Fatalf("delete token: %v", err)
+	}
+	if _, err := s.AccessTokenByValue(ctx, token); err == nil {
+		t.Fatal("expected error after delete")
+	}
+}
+
+func TestUnlinkOAuthIdentity(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	ctx := context.Background()
+
+	// OAuth-only user with two identities.
+	u, _ := s.FindOrCreateOAuthUser(ctx, "google", "g-1", "unlink@example.com", "Unlink", true)
+	if err := s.LinkOAuthIdentity(ctx, u.ID, "microsoft", "ms-1", "unlink@example.com"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	identities, _ := s.ListOAuthIdentities(ctx, u.ID)
+	if len(identities) != 2 {
+		t.Fatalf("identities = %+v", identities)
+	}
+
+	stranger := createTestUser(t, db, "stranger@example.com")
+	if err := s.UnlinkOAuthIdentity(ctx, stranger.ID, identities[0].ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unlink someone else's identity: %v", err)
+	}
+	if err := s.LinkOAuthIdentity(ctx, stranger.ID, "google", "g-1", "x@example.com"); !errors.Is(err, ErrIdentityLinked) {
+		t.Fatalf("link someone else's identity: %v", err)
+	}
+
+	if err := s.UnlinkOAuthIdentity(ctx, u.ID, identities[0].ID); err != nil {
+		t.Fatalf("unlink first: %v", err)
+	}
+	if err := s.UnlinkOAuthIdentity(ctx, u.ID, identities[1].ID); !errors.Is(err, ErrLastLoginMethod) {
+		t.Fatalf("unlink last without password: %v", err)
+	}
+
+	// With a password the last identity can go.
+	hash, _ := HashPassword("password123")
+	db.ExecContext(ctx, "UPDATE users SET password_hash=$2 WHERE id=$1", u.ID, hash)
+	if err := s.UnlinkOAuthIdentity(ctx, u.ID, identities[1].ID); err != nil {
+		t.Fatalf("unlink last with password: %v", err)
+	}
+}
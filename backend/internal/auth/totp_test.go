@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 test key from RFC 6238 appendix B,
+// "12345678901234567890", base32-encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTPRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got := hotp(key, uint64(totpStep(time.Unix(tt.unix, 0))), 8)
+		if got != tt.want {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// Six-digit codes are the low digits of the eight-digit vectors.
+	got, err := TOTPCode(rfc6238Secret, time.Unix(1111111109, 0))
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	if got != "081804" {
+		t.Fatalf("code = %s, want 081804", got)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(rfc6238Secret, now)
+
+	tests := []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{"same period", now, true},
+		{"previous period", now.Add(-totpPeriod * time.Second), true},
+		{"next period", now.Add(totpPeriod * time.Second), true},
+		{"two periods late", now.Add(2 * totpPeriod * time.Second), false},
+		{"two periods early", now.Add(-2 * totpPeriod * time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(rfc6238Secret, code, tt.at)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && step != totpStep(now) {
+				t.Fatalf("step = %d, want %d", step, totpStep(now))
+			}
+		})
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, bad, now); ok {
+			t.Errorf("ValidateTOTP(%q) = ok", bad)
+		}
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("len = %d, want 32", len(secret))
+	}
+	if _, err := TOTPCode(secret, time.Now()); err != nil {
+		t.Fatalf("secret does not decode: %v", err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	got := TOTPURI("JBSWY3DPEHPK3PXP", "FlowBoard", "ada@example.com")
+	want := "otpauth://totp/FlowBoard:ada@example.com?algorithm=SHA1&digits=6&issuer=FlowBoard&period=30&secret=JBSWY3DPEHPK3PXP"
+	if got != want {
+		t.Fatalf("uri = %s\nwant  %s", got, want)
+	}
+
+	png, err := QRCodePNG(got)
+	if err != nil {
+		t.Fatalf("qr: %v", err)
+	}
+	if !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Fatal("not a PNG")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' {
+			t.Fatalf("code %q not formatted xxxxx-xxxxx", c)
+		}
+		if seen[c] {
+			t.Fatalf("duplicate code %q", c)
+		}
+		seen[c] = true
+	}
+	if normalizeRecoveryCode(strings.ToUpper(codes[0])) != strings.ReplaceAll(codes[0], "-", "") {
+		t.Fatal("normalization should ignore case and dashes")
+	}
+}
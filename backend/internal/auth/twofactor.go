@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+	"trello-clone/internal/httputil"
+)
+
+const (
+	// totpIssuer labels the account in authenticator apps.
+	totpIssuer = "FlowBoard"
+	// recoveryCodeCount is how many recovery codes are issued at a time.
+	recoveryCodeCount = 10
+	// loginChallengeTTL is how long a user has to enter their second factor
+	// after the password.
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts is how many codes may be tried per challenge.
+	loginChallengeAttempts = 5
+)
+
+// SetupTwoFactor starts TOTP enrollment: it generates a secret and returns
+// it with the otpauth URI and a QR code of it. 2FA stays off until
+// ConfirmTwoFactor.
+func (h *Handler) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := h.Store.SetPendingTOTPSecret(r.Context(), u.ID, secret); err != nil {
+		if errors.Is(err, ErrTwoFactorEnabled) {
+			httputil.Error(w, http.StatusConflict, err.Error())
+			return
+		}
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	uri := TOTPURI(secret, totpIssuer, u.Email)
+	png, err := QRCodePNG(uri)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, map[string]string{
+		"secret":  secret,
+		"uri":     uri,
+		"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTwoFactor enables 2FA once the user proves their app generates
+// codes for the pending secret, and returns the recovery codes. They are
+// shown only in this response.
+func (h *Handler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+
+	secret, enabled, err := h.Store.TOTPSecret(r.Context(), u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if enabled {
+		httputil.Error(w, http.StatusConflict, ErrTwoFactorEnabled.Error())
+		return
+	}
+	if secret == "" {
+		httputil.Error(w, http.StatusBadRequest, "two-factor setup not started")
+		return
+	}
+	step, ok := ValidateTOTP(secret, req.Code, time.Now())
+	if !ok {
+		httputil.Error(w, http.StatusBadRequest, "invalid code")
+		return
+	}
+	if _, err := h.Store.UseTOTPStep(r.Context(), u.ID, step); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	codes, err := GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := h.Store.EnableTwoFactor(r.Context(), u.ID, codes); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := h.rotateSession(w, r); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTwoFactor turns 2FA off. It needs a current code or a recovery
+// code, so a hijacked session alone can't remove the second factor. Wrong
+// codes count towards the login lockout.
+func (h *Handler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(r.Context())
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if !u.TwoFactorEnabled {
+		httputil.Error(w, http.StatusBadRequest, "two-factor authentication not enabled")
+		return
+	}
+
+	_, ip := clientInfo(r)
+	if !h.checkLoginLockout(w, r, ip, u.Email) {
+		return
+	}
+	ok, err := h.checkSecondFactor(r.Context(), u.ID, req.Code)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		if err := h.recordLoginFailure(r.Context(), ip, u.Email); err != nil {
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		httputil.Error(w, http.StatusBadRequest, "invalid code")
+		return
+	}
+
+	if err := h.Store.DisableTwoFactor(r.Context(), u.ID); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := h.rotateSession(w, r); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginTwoFactor completes a login that Login answered with a challenge.
+// code is a TOTP code or one of the user's recovery codes. Wrong codes
+// count towards the login lockout like wrong passwords, so asking for a
+// fresh challenge doesn't buy more guesses.
+func (h *Handler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+
+	userID, err := h.Store.AttemptLoginChallenge(r.Context(), req.Challenge, loginChallengeAttempts)
+	if err != nil {
+		httputil.Error(w, http.StatusUnauthorized, "login expired, sign in again")
+		return
+	}
+	u, err := h.Store.UserByID(r.Context(), userID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	_, ip := clientInfo(r)
+	if !h.checkLoginLockout(w, r, ip, u.Email) {
+		return
+	}
+	ok, err := h.checkSecondFactor(r.Context(), userID, req.Code)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		if err := h.recordLoginFailure(r.Context(), ip, u.Email); err != nil {
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		httputil.Error(w, http.StatusUnauthorized, "invalid code")
+		return
+	}
+
+	h.Store.DeleteLoginChallenge(r.Context(), req.Challenge)
+	if err := h.Store.ClearLoginFailures(r.Context(), LoginScopeAccount, accountSubject(u.Email)); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := h.startSession(w, r, u.ID); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, u)
+}
+
+// writeLoginChallenge answers a correct password for a user with 2FA on.
+func (h *Handler) writeLoginChallenge(w http.ResponseWriter, r *http.Request, u *User) {
+	challenge, err := h.Store.CreateLoginChallenge(r.Context(), u.ID, loginChallengeTTL)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, map[string]any{
+		"two_factor_required": true,
+		"challenge":           challenge,
+	})
+}
+
+// checkSecondFactor accepts a TOTP code that hasn't been used yet, or an
+// unused recovery code.
+func (h *Handler) checkSecondFactor(ctx context.Context, userID, code string) (bool, error) {
+	if len(code) == totpDigits {
+		secret, enabled, err := h.Store.TOTPSecret(ctx, userID)
+		if err != nil || !enabled {
+			return false, err
+		}
+		step, ok := ValidateTOTP(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return h.Store.UseTOTPStep(ctx, userID, step)
+	}
+	return h.Store.UseRecoveryCode(ctx, userID, code)
+}
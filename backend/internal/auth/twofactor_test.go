@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"trello-clone/internal/testutil"
+)
+
+// authedRequest calls handler as u.
+func authedRequest(t *testing.T, handler http.HandlerFunc, u *User, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestTwoFactorFlow(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	ctx := context.Background()
+	u := createTestUser(t, db, "2fa@example.com")
+
+	// Enroll.
+	w := authedRequest(t, h.SetupTwoFactor, u, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("setup: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	var setup map[string]string
+	json.Unmarshal(w.Body.Bytes(), &setup)
+	secret := setup["secret"]
+	if !strings.HasPrefix(setup["uri"], "otpauth://totp/") || !strings.HasPrefix(setup["qr_code"], "data:image/png;base64,") {
+		t.Fatalf("setup response = %v", setup)
+	}
+
+	if w := authedRequest(t, h.ConfirmTwoFactor, u, `{"code":"000000"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("confirm with wrong code: status = %d", w.Code)
+	}
+	now := time.Now()
+	code, _ := TOTPCode(secret, now)
+	w = authedRequest(t, h.ConfirmTwoFactor, u, `{"code":"`+code+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &confirmed)
+	if len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("recovery codes = %d, want %d", len(confirmed.RecoveryCodes), recoveryCodeCount)
+	}
+
+	// The password alone now yields a challenge, not a session.
+	w = jsonRequest(t, h.Login, "/api/auth/login", `{"email":"2fa@example.com","password":"password123"}`)
+	var login struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		Challenge         string `json:"challenge"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if w.Code != http.StatusOK || !login.TwoFactorRequired || login.Challenge == "" {
+		t.Fatalf("login: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatal("no session cookie before the second factor")
+	}
+
+	// The code used to confirm enrollment can't be replayed.
+	w = jsonRequest(t, h.LoginTwoFactor, "/api/auth/login/2fa", `{"challenge":"`+login.Challenge+`","code":"`+code+`"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// A recovery code works once.
+	recovery := strings.ToUpper(confirmed.RecoveryCodes[0])
+	w = jsonRequest(t, h.LoginTwoFactor, "/api/auth/login/2fa", `{"challenge":"`+login.Challenge+`","code":"`+recovery+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("recovery code: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	var found bool
+	for _, c := range w.Result().Cookies() {
+		found = found || (c.Name == "session" && c.Value != "")
+	}
+	if !found {
+		t.Fatal("expected session cookie")
+	}
+
+	// The challenge is spent.
+	w = jsonRequest(t, h.LoginTwoFactor, "/api/auth/login/2fa", `{"challenge":"`+login.Challenge+`","code":"`+recovery+`"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused challenge: status = %d", w.Code)
+	}
+	if ok, _ := store.UseRecoveryCode(ctx, u.ID, recovery); ok {
+		t.Fatal("recovery code should be single use")
+	}
+
+	// Disabling needs a fresh code.
+	u, _ = store.UserByID(ctx, u.ID)
+	if w := authedRequest(t, h.DisableTwoFactor, u, `{"code":"123456"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("disable with wrong code: status = %d", w.Code)
+	}
+	next, _ := TOTPCode(secret, now.Add(totpPeriod*time.Second))
+	if w := authedRequest(t, h.DisableTwoFactor, u, `{"code":"`+next+`"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("disable: status = %d; body = %s", w.Code, w.Body.String())
+	}
+	w = jsonRequest(t, h.Login, "/api/auth/login", `{"email":"2fa@example.com","password":"password123"}`)
+	if len(w.Result().Cookies()) == 0 {
+		t.Fatal("login should create a session once 2FA is off")
+	}
+}
+
+func TestLoginChallengeAttempts(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	ctx := context.Background()
+	u := createTestUser(t, db, "attempts@example.com")
+
+	challenge, _ := store.CreateLoginChallenge(ctx, u.ID, time.Minute)
+	for i := range loginChallengeAttempts {
+		if _, err := store.AttemptLoginChallenge(ctx, challenge, loginChallengeAttempts); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+	if _, err := store.AttemptLoginChallenge(ctx, challenge, loginChallengeAttempts); err != ErrInvalidToken {
+		t.Fatalf("err = %v, want ErrInvalidToken", err)
+	}
+
+	expired, _ := store.CreateLoginChallenge(ctx, u.ID, -time.Second)
+	if _, err := store.AttemptLoginChallenge(ctx, expired, loginChallengeAttempts); err != ErrInvalidToken {
+		t.Fatalf("expired: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestLoginTwoFactorLockout(t *testing.T) {
+	db := testutil.SetupDB(t)
+	store := &Store{DB: db}
+	h := &Handler{Store: store}
+	ctx := context.Background()
+	u := createTestUser(t, db, "2fa-guess@example.com")
+
+	secret, _ := GenerateTOTPSecret()
+	store.SetPendingTOTPSecret(ctx, u.ID, secret)
+	codes, _ := GenerateRecoveryCodes(recoveryCodeCount)
+	store.EnableTwoFactor(ctx, u.ID, codes)
+
+	// Each fresh challenge allows a few guesses, but every wrong code
+	// counts against the account, so the password stops helping.
+	const login = `{"email":"2fa-guess@example.com","password":"password123"}`
+	for i := 0; ; i++ {
+		if i > accountLoginLimit.Free+1 {
+			t.Fatal("account never locked out")
+		}
+		w := jsonRequest(t, h.Login, "/api/auth/login", login)
+		if w.Code == http.StatusTooManyRequests {
+			break
+		}
+		var resp struct {
+			Challenge string `json:"challenge"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK || resp.Challenge == "" {
+			t.Fatalf("login %d: status = %d; body = %s", i+1, w.Code, w.Body.String())
+		}
+		w = jsonRequest(t, h.LoginTwoFactor, "/api/auth/login/2fa", `{"challenge":"`+resp.Challenge+`","code":"999999"}`)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status = %d", i+1, w.Code)
+		}
+	}
+
+	// A challenge issued before the lockout is refused too.
+	challenge, _ := store.CreateLoginChallenge(ctx, u.ID, time.Minute)
+	code, _ := TOTPCode(secret, time.Now())
+	w := jsonRequest(t, h.LoginTwoFactor, "/api/auth/login/2fa", `{"challenge":"`+challenge+`","code":"`+code+`"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
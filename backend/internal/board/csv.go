@@ -0,0 +1,230 @@
+package board
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"trello-clone/internal/auth"
+	"trello-clone/internal/httputil"
+)
+
+var csvHeader = []string{"column", "position", "title", "description", "created_at", "updated_at", "due_at"}
+
+// csvFormulaStart holds the characters a spreadsheet may read as the start
+// of a formula.
+const csvFormulaStart = "=+-@\t\r"
+
+// csvSafe keeps spreadsheets from evaluating a user-written cell as a
+// formula by prefixing cells that start like one with a quote. Cells that
+// csvUnquote would change get the prefix too, so a title the user wrote
+// as '=x survives a round trip.
+func csvSafe(s string) string {
+	if s != "" && (strings.ContainsRune(csvFormulaStart, rune(s[0])) || csvUnquote(s) != s) {
+		return "'" + s
+	}
+	return s
+}
+
+// csvUnquote undoes csvSafe, so exported files import unchanged. It only
+// strips a quote that csvSafe could have added: one followed by a formula
+// character or by another quote.
+func csvUnquote(s string) string {
+	if len(s) > 1 && s[0] == '\'' && (s[1] == '\'' || strings.ContainsRune(csvFormulaStart, rune(s[1]))) {
+		return s[1:]
+	}
+	return s
+}
+
+func (h *Handler) ExportCardsCSV(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if _, err := h.Store.GetBoard(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "board not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="board-%s.csv"`, id))
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return
+	}
+	err := h.Store.EachBoardCard(r.Context(), id, func(columnName string, c Card) error {
+		var dueAt string
+		if c.DueAt != nil {
+			dueAt = c.DueAt.UTC().Format(time.RFC3339)
+		}
+		return cw.Write([]string{
+			csvSafe(columnName),
+			fmt.Sprint(c.Position),
+			csvSafe(c.Title),
+			csvSafe(c.Description),
+			c.CreatedAt.UTC().Format(time.RFC3339),
+			c.UpdatedAt.UTC().Format(time.RFC3339),
+			dueAt,
+		})
+	})
+	cw.Flush()
+	// Headers are already sent at this point, so all we can do is log.
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "csv export", "board_id", id, "error", err)
+	}
+}
+
+type importRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportCardsCSV creates one card per CSV row. The header names holding the
+// column, title, description and due_at (RFC 3339) are taken from the query
+// parameters of the same name and default to those names. Columns that do
+// not exist on the board are created. Cards are appended to their column in
+// file order, so the position column is ignored, as are created_at and
+// updated_at. Bad rows are reported individually and do not abort the
+// import.
+func (h *Handler) ImportCardsCSV(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	b, err := h.Store.GetBoard(r.Context(), id, u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusNotFound, "board not found")
+		return
+	}
+
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				httputil.InvalidBody(w, err)
+				return
+			}
+			httputil.Error(w, http.StatusBadRequest, "file required")
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	// Read the whole file first, so one over the size limit is rejected
+	// before any card is created.
+	data, err := io.ReadAll(body)
+	if err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		httputil.Error(w, http.StatusBadRequest, "invalid csv header")
+		return
+	}
+
+	q := r.URL.Query()
+	mapping := func(field string) int {
+		name := q.Get(field)
+		if name == "" {
+			name = field
+		}
+		for i, hdr := range header {
+			if strings.EqualFold(strings.TrimSpace(hdr), strings.TrimSpace(name)) {
+				return i
+			}
+		}
+		return -1
+	}
+	columnIdx, titleIdx, descIdx, dueIdx := mapping("column"), mapping("title"), mapping("description"), mapping("due_at")
+	if columnIdx < 0 || titleIdx < 0 {
+		httputil.Error(w, http.StatusBadRequest, "csv must have column and title fields")
+		return
+	}
+
+	columnIDs := make(map[string]string, len(b.Columns))
+	for _, c := range b.Columns {
+		columnIDs[c.Name] = c.ID
+	}
+
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return csvUnquote(strings.TrimSpace(record[i]))
+	}
+
+	created := 0
+	columnsCreated := []string{}
+	rowErrors := []importRowError{}
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				rowErrors = append(rowErrors, importRowError{Row: row, Error: perr.Err.Error()})
+				continue
+			}
+			httputil.Error(w, http.StatusBadRequest, "invalid csv")
+			return
+		}
+
+		columnName, title := field(record, columnIdx), field(record, titleIdx)
+		if columnName == "" {
+			rowErrors = append(rowErrors, importRowError{Row: row, Error: "column required"})
+			continue
+		}
+		if title == "" {
+			rowErrors = append(rowErrors, importRowError{Row: row, Error: "title required"})
+			continue
+		}
+		var dueAt *time.Time
+		if v := field(record, dueIdx); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				rowErrors = append(rowErrors, importRowError{Row: row, Error: "due_at must be an RFC 3339 timestamp"})
+				continue
+			}
+			dueAt = &t
+		}
+
+		columnID, ok := columnIDs[columnName]
+		if !ok {
+			c, err := h.Store.CreateColumn(r.Context(), b.ID, columnName)
+			if err != nil {
+				rowErrors = append(rowErrors, importRowError{Row: row, Error: "failed to create column"})
+				continue
+			}
+			columnID = c.ID
+			columnIDs[columnName] = columnID
+			columnsCreated = append(columnsCreated, columnName)
+		}
+
+		if _, err := h.Store.CreateCardDue(r.Context(), columnID, title, field(record, descIdx), dueAt); err != nil {
+			rowErrors = append(rowErrors, importRowError{Row: row, Error: "failed to create card"})
+			continue
+		}
+		created++
+	}
+
+	httputil.JSON(w, http.StatusOK, map[string]any{
+		"created":         created,
+		"columns_created": columnsCreated,
+		"errors":          rowErrors,
+	})
+}
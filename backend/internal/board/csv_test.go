@@ -0,0 +1,32 @@
+package board
+
+import "testing"
+
+func TestCSVSafe(t *testing.T) {
+	for in, want := range map[string]string{
+		"":            "",
+		"Plain title": "Plain title",
+		"a=b":         "a=b",
+		"=1+2":        "'=1+2",
+		"+1":          "'+1",
+		"-1":          "'-1",
+		"@SUM(A1)":    "'@SUM(A1)",
+		"\tx":         "'\tx",
+		"\rx":         "'\rx",
+		"'quoted":     "'quoted",
+		"'=1+2":       "''=1+2",
+		"''x":         "'''x",
+	} {
+		got := csvSafe(in)
+		if got != want {
+			t.Errorf("csvSafe(%q) = %q, want %q", in, got, want)
+		}
+		if back := csvUnquote(got); back != in {
+			t.Errorf("csvUnquote(%q) = %q, want %q", got, back, in)
+		}
+	}
+	// A quote csvSafe didn't add is left alone.
+	if got := csvUnquote("'quoted"); got != "'quoted" {
+		t.Errorf("csvUnquote kept no quote: %q", got)
+	}
+}
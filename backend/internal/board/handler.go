@@ -1,6 +1,7 @@
 package board
 
 import (
+	"encoding/json"
 	"net/http"
 	"trello-clone/internal/auth"
 	"trello-clone/internal/httputil"
@@ -30,7 +31,11 @@ func (h *Handler) CreateBoard(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name string `json:"name"`
 	}
-	if err := httputil.Decode(r, &req); err != nil || req.Name == "" {
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.Name == "" {
 		httputil.Error(w, http.StatusBadRequest, "name required")
 		return
 	}
@@ -79,7 +84,11 @@ func (h *Handler) CreateColumn(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name string `json:"name"`
 	}
-	if err := httputil.Decode(r, &req); err != nil || req.Name == "" {
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.Name == "" {
 		httputil.Error(w, http.StatusBadRequest, "name required")
 		return
 	}
@@ -106,7 +115,7 @@ func (h *Handler) UpdateColumn(w http.ResponseWriter, r *http.Request) {
 		Position *int    `json:"position"`
 	}
 	if err := httputil.Decode(r, &req); err != nil {
-		httputil.Error(w, http.StatusBadRequest, "invalid request body")
+		httputil.InvalidBody(w, err)
 		return
 	}
 
@@ -149,7 +158,11 @@ func (h *Handler) CreateCard(w http.ResponseWriter, r *http.Request) {
 		Title       string `json:"title"`
 		Description string `json:"description"`
 	}
-	if err := httputil.Decode(r, &req); err != nil || req.Title == "" {
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.Title == "" {
 		httputil.Error(w, http.StatusBadRequest, "title required")
 		return
 	}
@@ -172,15 +185,26 @@ func (h *Handler) UpdateCard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Title       *string `json:"title"`
-		Description *string `json:"description"`
+		Title       *string         `json:"title"`
+		Description *string         `json:"description"`
+		DueAt       json.RawMessage `json:"due_at"`
 	}
 	if err := httputil.Decode(r, &req); err != nil {
-		httputil.Error(w, http.StatusBadRequest, "invalid request body")
+		httputil.InvalidBody(w, err)
 		return
 	}
 
-	c, err := h.Store.UpdateCard(r.Context(), id, req.Title, req.Description)
+	update := CardUpdate{Title: req.Title, Description: req.Description}
+	// due_at is tri-state: absent leaves it alone, null clears it.
+	if len(req.DueAt) > 0 {
+		update.SetDueAt = true
+		if err := json.Unmarshal(req.DueAt, &update.DueAt); err != nil {
+			httputil.Error(w, http.StatusBadRequest, "due_at must be an RFC 3339 timestamp or null")
+			return
+		}
+	}
+
+	c, err := h.Store.UpdateCard(r.Context(), id, update)
 	if err != nil {
 		httputil.Error(w, http.StatusInternalServerError, "failed to update card")
 		return
@@ -217,7 +241,7 @@ func (h *Handler) MoveColumn(w http.ResponseWriter, r *http.Request) {
 		Position int `json:"position"`
 	}
 	if err := httputil.Decode(r, &req); err != nil {
-		httputil.Error(w, http.StatusBadRequest, "invalid request body")
+		httputil.InvalidBody(w, err)
 		return
 	}
 
@@ -242,7 +266,11 @@ func (h *Handler) MoveCard(w http.ResponseWriter, r *http.Request) {
 		ColumnID string `json:"column_id"`
 		Position int    `json:"position"`
 	}
-	if err := httputil.Decode(r, &req); err != nil || req.ColumnID == "" {
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	if req.ColumnID == "" {
 		httputil.Error(w, http.StatusBadRequest, "column_id required")
 		return
 	}
@@ -1,17 +1,29 @@
 package board_test
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"trello-clone/internal/server"
 	"trello-clone/internal/testutil"
 )
 
+// newServer builds the server under test.
+func newServer(t *testing.T, cfg server.Config) *http.Server {
+	t.Helper()
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	return srv
+}
+
 func signupAndGetCookie(t *testing.T, srv *http.Server) *http.Cookie {
 	t.Helper()
 	body := `{"email":"handler@example.com","password":"password123","name":"Handler User"}`
@@ -50,7 +62,7 @@ func doRequest(t *testing.T, srv *http.Server, method, path string, body string,
 
 func TestListBoardsHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	w := doRequest(t, srv, http.MethodGet, "/api/boards", "", cookie)
@@ -67,7 +79,7 @@ func TestListBoardsHandler(t *testing.T) {
 
 func TestCreateBoardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	w := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Test Board"}`, cookie)
@@ -84,7 +96,7 @@ func TestCreateBoardHandler(t *testing.T) {
 
 func TestGetBoardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	// Create board
@@ -112,7 +124,7 @@ func TestGetBoardHandler(t *testing.T) {
 
 func TestDeleteBoardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Delete Board"}`, cookie)
@@ -128,7 +140,7 @@ func TestDeleteBoardHandler(t *testing.T) {
 
 func TestCreateColumnHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Col Board"}`, cookie)
@@ -150,7 +162,7 @@ func TestCreateColumnHandler(t *testing.T) {
 
 func TestUpdateColumnHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Upd Col Board"}`, cookie)
@@ -179,7 +191,7 @@ func TestUpdateColumnHandler(t *testing.T) {
 
 func TestDeleteColumnHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Del Col Board"}`, cookie)
@@ -201,7 +213,7 @@ func TestDeleteColumnHandler(t *testing.T) {
 
 func TestCreateCardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Card Board"}`, cookie)
@@ -229,7 +241,7 @@ func TestCreateCardHandler(t *testing.T) {
 
 func TestUpdateCardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Upd Card Board"}`, cookie)
@@ -263,7 +275,7 @@ func TestUpdateCardHandler(t *testing.T) {
 
 func TestDeleteCardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Del Card Board"}`, cookie)
@@ -290,7 +302,7 @@ func TestDeleteCardHandler(t *testing.T) {
 
 func TestMoveCardHandler(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 	cookie := signupAndGetCookie(t, srv)
 
 	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Move Card Board"}`, cookie)
@@ -325,9 +337,181 @@ func TestMoveCardHandler(t *testing.T) {
 	}
 }
 
+func TestExportCardsCSVHandler(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+	cookie := signupAndGetCookie(t, srv)
+
+	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"CSV Board"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(cw.Body.Bytes(), &board)
+	boardID := board["id"].(string)
+
+	gw := doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID, "", cookie)
+	var fullBoard map[string]any
+	json.Unmarshal(gw.Body.Bytes(), &fullBoard)
+	columns := fullBoard["columns"].([]any)
+	colID := columns[0].(map[string]any)["id"].(string)
+
+	doRequest(t, srv, http.MethodPost, fmt.Sprintf("/api/columns/%s/cards", colID), `{"title":"Export me","description":"line1, with comma"}`, cookie)
+	doRequest(t, srv, http.MethodPost, fmt.Sprintf("/api/columns/%s/cards", colID), `{"title":"=HYPERLINK(\"https://evil.example.com\")","description":"+cmd|' /C calc'!A0"}`, cookie)
+
+	w := doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID+"/cards.csv", "", cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("content-type = %q, want text/csv", ct)
+	}
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse csv: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("records = %d, want 3 (header + 2 cards)", len(records))
+	}
+	if records[1][0] != "Todo" || records[1][2] != "Export me" || records[1][3] != "line1, with comma" {
+		t.Fatalf("record = %v", records[1])
+	}
+	// Cells that would run as spreadsheet formulas are quoted.
+	if records[2][2] != `'=HYPERLINK("https://evil.example.com")` || records[2][3] != `'+cmd|' /C calc'!A0` {
+		t.Fatalf("formula record = %q", records[2])
+	}
+}
+
+func TestImportCardsCSVHandler(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+	cookie := signupAndGetCookie(t, srv)
+
+	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Import Board"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(cw.Body.Bytes(), &board)
+	boardID := board["id"].(string)
+
+	body := "List,Name,Notes\nTodo,First,desc one\nBacklog,Second,\nTodo,,missing title\n"
+	path := "/api/boards/" + boardID + "/cards/import?column=List&title=Name&description=Notes"
+	w := doRequest(t, srv, http.MethodPost, path, body, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var report struct {
+		Created        int      `json:"created"`
+		ColumnsCreated []string `json:"columns_created"`
+		Errors         []struct {
+			Row   int    `json:"row"`
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Created != 2 {
+		t.Fatalf("created = %d, want 2", report.Created)
+	}
+	if len(report.ColumnsCreated) != 1 || report.ColumnsCreated[0] != "Backlog" {
+		t.Fatalf("columns_created = %v, want [Backlog]", report.ColumnsCreated)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Row != 4 {
+		t.Fatalf("errors = %+v, want one error on row 4", report.Errors)
+	}
+
+	gw := doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID, "", cookie)
+	var fullBoard map[string]any
+	json.Unmarshal(gw.Body.Bytes(), &fullBoard)
+	if columns := fullBoard["columns"].([]any); len(columns) != 4 {
+		t.Fatalf("columns = %d, want 4", len(columns))
+	}
+}
+
+func TestImportCardsCSVDueAt(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+	cookie := signupAndGetCookie(t, srv)
+
+	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Import Board"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(cw.Body.Bytes(), &board)
+	boardID := board["id"].(string)
+
+	body := "column,position,title,due_at\nTodo,7,Due,2026-11-01T09:00:00Z\nTodo,0,Bad date,tomorrow\n"
+	w := doRequest(t, srv, http.MethodPost, "/api/boards/"+boardID+"/cards/import", body, cookie)
+	var report struct {
+		Created int `json:"created"`
+		Errors  []struct {
+			Row int `json:"row"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || report.Created != 1 || len(report.Errors) != 1 || report.Errors[0].Row != 3 {
+		t.Fatalf("status = %d, report = %+v; want one card and an error on row 3", w.Code, report)
+	}
+
+	gw := doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID, "", cookie)
+	var full struct {
+		Columns []struct {
+			Name  string `json:"name"`
+			Cards []struct {
+				Position int        `json:"position"`
+				DueAt    *time.Time `json:"due_at"`
+			} `json:"cards"`
+		} `json:"columns"`
+	}
+	json.Unmarshal(gw.Body.Bytes(), &full)
+	cards := full.Columns[0].Cards
+	want := time.Date(2026, 11, 1, 9, 0, 0, 0, time.UTC)
+	if len(cards) != 1 || cards[0].DueAt == nil || !cards[0].DueAt.Equal(want) || cards[0].Position != 0 {
+		t.Fatalf("%s cards = %+v, want one due 2026-11-01 appended at position 0", full.Columns[0].Name, cards)
+	}
+}
+
+func TestImportCardsCSVMissingMapping(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+	cookie := signupAndGetCookie(t, srv)
+
+	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Import Board"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(cw.Body.Bytes(), &board)
+	boardID := board["id"].(string)
+
+	w := doRequest(t, srv, http.MethodPost, "/api/boards/"+boardID+"/cards/import", "foo,bar\n1,2\n", cookie)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExportMarkdownHandler(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+	cookie := signupAndGetCookie(t, srv)
+
+	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"MD Board"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(cw.Body.Bytes(), &board)
+	boardID := board["id"].(string)
+
+	w := doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID+"/export.md?columns=Todo,Done", "", cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	md := w.Body.String()
+	if !strings.HasPrefix(md, "# MD Board\n") {
+		t.Fatalf("markdown = %q, want board heading", md)
+	}
+	if !strings.Contains(md, "## Done") || strings.Contains(md, "## Doing") {
+		t.Fatalf("markdown = %q, want only Todo and Done columns", md)
+	}
+
+	w = doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID+"/export.md?flavor=html", "", cookie)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
 func TestUnauthorized(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := server.New(server.Config{DB: db})
+	srv := newServer(t, server.Config{DB: db})
 
 	endpoints := []struct {
 		method string
@@ -344,6 +528,9 @@ func TestUnauthorized(t *testing.T) {
 		{http.MethodPatch, "/api/cards/fake-id"},
 		{http.MethodDelete, "/api/cards/fake-id"},
 		{http.MethodPost, "/api/cards/fake-id/move"},
+		{http.MethodGet, "/api/boards/fake-id/cards.csv"},
+		{http.MethodPost, "/api/boards/fake-id/cards/import"},
+		{http.MethodGet, "/api/boards/fake-id/export.md"},
 		{http.MethodPost, "/api/auth/logout"},
 		{http.MethodGet, "/api/auth/me"},
 	}
@@ -0,0 +1,139 @@
+package board
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"trello-clone/internal/auth"
+	"trello-clone/internal/httputil"
+)
+
+type MarkdownFlavor string
+
+const (
+	FlavorGFM        MarkdownFlavor = "gfm"
+	FlavorCommonMark MarkdownFlavor = "commonmark"
+)
+
+type MarkdownOptions struct {
+	// Descriptions renders each card description as an indented block
+	// below the card.
+	Descriptions bool
+	// Columns limits output to the named columns. Empty means all columns.
+	Columns []string
+	// Flavor selects GitHub-flavored task lists ("- [ ] title") or plain
+	// CommonMark bullets. Defaults to GFM.
+	Flavor MarkdownFlavor
+}
+
+// RenderMarkdown writes b as Markdown: a top-level heading with the board
+// name, one second-level heading per column and one list item per card.
+// b must be loaded with its columns and cards, as returned by GetBoard.
+func RenderMarkdown(w io.Writer, b *Board, opts MarkdownOptions) error {
+	bw := bufio.NewWriter(w)
+
+	include := func(name string) bool {
+		if len(opts.Columns) == 0 {
+			return true
+		}
+		for _, c := range opts.Columns {
+			if strings.EqualFold(c, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	marker := "- [ ] "
+	if opts.Flavor == FlavorCommonMark {
+		marker = "- "
+	}
+
+	bw.WriteString("# " + escapeMarkdown(b.Name, opts.Flavor) + "\n")
+	for _, col := range b.Columns {
+		if !include(col.Name) {
+			continue
+		}
+		bw.WriteString("\n## " + escapeMarkdown(col.Name, opts.Flavor) + "\n\n")
+		if len(col.Cards) == 0 {
+			bw.WriteString("_No cards_\n")
+			continue
+		}
+		for _, card := range col.Cards {
+			bw.WriteString(marker + escapeMarkdown(card.Title, opts.Flavor) + "\n")
+			if !opts.Descriptions || strings.TrimSpace(card.Description) == "" {
+				continue
+			}
+			// Indent to the list item's content column so the description
+			// stays part of the item.
+			bw.WriteString("\n")
+			for _, line := range strings.Split(strings.TrimRight(card.Description, "\n"), "\n") {
+				if strings.TrimSpace(line) == "" {
+					bw.WriteString("\n")
+					continue
+				}
+				bw.WriteString("  " + line + "\n")
+			}
+			bw.WriteString("\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// escapeMarkdown backslash-escapes characters that would otherwise be read
+// as inline markup in a heading or list item.
+func escapeMarkdown(s string, flavor MarkdownFlavor) string {
+	special := "\\`*_[]<>#|!"
+	if flavor != FlavorCommonMark {
+		special += "~"
+	}
+	s = strings.ReplaceAll(s, "\n", " ")
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (h *Handler) ExportMarkdown(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	b, err := h.Store.GetBoard(r.Context(), id, u.ID)
+	if err != nil {
+		httputil.Error(w, http.StatusNotFound, "board not found")
+		return
+	}
+
+	q := r.URL.Query()
+	opts := MarkdownOptions{
+		Descriptions: q.Get("descriptions") != "false",
+		Flavor:       FlavorGFM,
+	}
+	switch MarkdownFlavor(q.Get("flavor")) {
+	case "", FlavorGFM:
+	case FlavorCommonMark:
+		opts.Flavor = FlavorCommonMark
+	default:
+		httputil.Error(w, http.StatusBadRequest, "flavor must be gfm or commonmark")
+		return
+	}
+	for _, c := range q["columns"] {
+		for _, name := range strings.Split(c, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.Columns = append(opts.Columns, name)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	if err := RenderMarkdown(w, b, opts); err != nil {
+		// Headers are already sent at this point, so all we can do is log.
+		slog.ErrorContext(r.Context(), "markdown export", "board_id", id, "error", err)
+	}
+}
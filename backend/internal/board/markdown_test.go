@@ -0,0 +1,66 @@
+package board
+
+import (
+	"strings"
+	"testing"
+)
+
+func markdownTestBoard() *Board {
+	return &Board{
+		Name: "Sprint 12",
+		Columns: []Column{
+			{Name: "Todo", Cards: []Card{
+				{Title: "Write *docs*", Description: "First line\nSecond line"},
+				{Title: "Plain"},
+			}},
+			{Name: "Done", Cards: []Card{}},
+		},
+	}
+}
+
+func TestRenderMarkdownGFM(t *testing.T) {
+	var sb strings.Builder
+	if err := RenderMarkdown(&sb, markdownTestBoard(), MarkdownOptions{Descriptions: true}); err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	want := "# Sprint 12\n" +
+		"\n## Todo\n\n" +
+		"- [ ] Write \\*docs\\*\n" +
+		"\n  First line\n  Second line\n\n" +
+		"- [ ] Plain\n" +
+		"\n## Done\n\n" +
+		"_No cards_\n"
+	if got := sb.String(); got != want {
+		t.Fatalf("markdown =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderMarkdownCommonMark(t *testing.T) {
+	var sb strings.Builder
+	RenderMarkdown(&sb, markdownTestBoard(), MarkdownOptions{Flavor: FlavorCommonMark})
+
+	got := sb.String()
+	if strings.Contains(got, "[ ]") {
+		t.Fatalf("commonmark output should not contain task list markers:\n%s", got)
+	}
+	if !strings.Contains(got, "- Plain\n") {
+		t.Fatalf("expected plain bullet for card:\n%s", got)
+	}
+	if strings.Contains(got, "First line") {
+		t.Fatalf("descriptions should be omitted:\n%s", got)
+	}
+}
+
+func TestRenderMarkdownColumnFilter(t *testing.T) {
+	var sb strings.Builder
+	RenderMarkdown(&sb, markdownTestBoard(), MarkdownOptions{Columns: []string{"done"}})
+
+	got := sb.String()
+	if strings.Contains(got, "## Todo") {
+		t.Fatalf("Todo column should be filtered out:\n%s", got)
+	}
+	if !strings.Contains(got, "## Done") {
+		t.Fatalf("expected Done column:\n%s", got)
+	}
+}
@@ -20,10 +20,30 @@ type Column struct {
 }
 
 type Card struct {
-	ID          string    `json:"id"`
-	ColumnID    string    `json:"column_id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Position    int       `json:"position"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          string     `json:"id"`
+	ColumnID    string     `json:"column_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Position    int        `json:"position"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DueAt       *time.Time `json:"due_at"`
+}
+
+// Activity kinds recorded in the card_activity log.
+const (
+	ActivityCreated = "card.created"
+	ActivityUpdated = "card.updated"
+	ActivityMoved   = "card.moved"
+)
+
+type Activity struct {
+	ID             string    `json:"id"`
+	BoardID        string    `json:"board_id"`
+	CardID         string    `json:"card_id"`
+	Kind           string    `json:"kind"`
+	CardTitle      string    `json:"card_title"`
+	ColumnName     string    `json:"column_name"`
+	FromColumnName string    `json:"from_column_name,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
 }
@@ -4,10 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 )
 
 type Store struct {
 	DB *sql.DB
+	// OnActivity, if set, is called for every activity entry inside the
+	// transaction that recorded it, so subscribers can write to the same
+	// transaction (e.g. a delivery outbox).
+	OnActivity func(ctx context.Context, tx *sql.Tx, a Activity) error
+	// AfterActivity, if set, is called for every activity entry once the
+	// transaction that recorded it has committed, for side effects that
+	// must not happen if it rolls back (e.g. counting it).
+	AfterActivity func(a Activity)
 }
 
 // Boards
@@ -63,10 +72,7 @@ func (s *Store) ListBoards(ctx context.Context, userID string) ([]Board, error)
 }
 
 func (s *Store) GetBoard(ctx context.Context, id, userID string) (*Board, error) {
-	b := &Board{}
-	err := s.DB.QueryRowContext(ctx,
-		`SELECT id, user_id, name, created_at FROM boards WHERE id=$1 AND user_id=$2`, id, userID,
-	).Scan(&b.ID, &b.UserID, &b.Name, &b.CreatedAt)
+	b, err := s.BoardSummary(ctx, id, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +94,19 @@ func (s *Store) GetBoard(ctx context.Context, id, userID string) (*Board, error)
 	return b, nil
 }
 
+// BoardSummary returns the user's board without its columns and cards, for
+// callers that only need its name or to check ownership.
+func (s *Store) BoardSummary(ctx context.Context, id, userID string) (*Board, error) {
+	b := &Board{}
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT id, user_id, name, created_at FROM boards WHERE id=$1 AND user_id=$2`, id, userID,
+	).Scan(&b.ID, &b.UserID, &b.Name, &b.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func (s *Store) DeleteBoard(ctx context.Context, id, userID string) error {
 	res, err := s.DB.ExecContext(ctx, `DELETE FROM boards WHERE id=$1 AND user_id=$2`, id, userID)
 	if err != nil {
@@ -175,7 +194,7 @@ func (s *Store) ColumnBoardOwner(ctx context.Context, columnID, userID string) (
 
 func (s *Store) listCards(ctx context.Context, columnID string) ([]Card, error) {
 	rows, err := s.DB.QueryContext(ctx,
-		`SELECT id, column_id, title, description, position, created_at FROM cards WHERE column_id=$1 ORDER BY position`, columnID,
+		`SELECT id, column_id, title, description, position, created_at, updated_at, due_at FROM cards WHERE column_id=$1 ORDER BY position`, columnID,
 	)
 	if err != nil {
 		return nil, err
@@ -185,7 +204,7 @@ func (s *Store) listCards(ctx context.Context, columnID string) ([]Card, error)
 	cards := []Card{}
 	for rows.Next() {
 		var c Card
-		if err := rows.Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt); err != nil {
+		if err := rows.Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt, &c.UpdatedAt, &c.DueAt); err != nil {
 			return nil, err
 		}
 		cards = append(cards, c)
@@ -194,27 +213,73 @@ func (s *Store) listCards(ctx context.Context, columnID string) ([]Card, error)
 }
 
 func (s *Store) CreateCard(ctx context.Context, columnID, title, description string) (*Card, error) {
+	return s.CreateCardDue(ctx, columnID, title, description, nil)
+}
+
+// CreateCardDue is CreateCard for a card with a due date; nil means none.
+func (s *Store) CreateCardDue(ctx context.Context, columnID, title, description string, dueAt *time.Time) (*Card, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	c := &Card{}
-	err := s.DB.QueryRowContext(ctx,
-		`INSERT INTO cards (column_id, title, description, position)
-		 VALUES ($1, $2, $3, COALESCE((SELECT MAX(position)+1 FROM cards WHERE column_id=$1), 0))
-		 RETURNING id, column_id, title, description, position, created_at`,
-		columnID, title, description,
-	).Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt)
-	return c, err
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO cards (column_id, title, description, due_at, position)
+		 VALUES ($1, $2, $3, $4, COALESCE((SELECT MAX(position)+1 FROM cards WHERE column_id=$1), 0))
+		 RETURNING id, column_id, title, description, position, created_at, updated_at, due_at`,
+		columnID, title, description, dueAt,
+	).Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt, &c.UpdatedAt, &c.DueAt)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.recordActivity(ctx, tx, c.ID, ActivityCreated, "")
+	if err != nil {
+		return nil, err
+	}
+	return c, s.commit(tx, a)
+}
+
+// CardUpdate holds the changes UpdateCard makes; nil fields are left
+// alone. DueAt is only applied with SetDueAt, so nil can clear it.
+type CardUpdate struct {
+	Title       *string
+	Description *string
+	SetDueAt    bool
+	DueAt       *time.Time
 }
 
-func (s *Store) UpdateCard(ctx context.Context, id string, title, description *string) (*Card, error) {
+// UpdateCard applies u to the card in a single statement.
+func (s *Store) UpdateCard(ctx context.Context, id string, u CardUpdate) (*Card, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	c := &Card{}
-	err := s.DB.QueryRowContext(ctx,
+	err = tx.QueryRowContext(ctx,
 		`UPDATE cards SET
 			title = COALESCE($2, title),
-			description = COALESCE($3, description)
+			description = COALESCE($3, description),
+			due_at = CASE WHEN $4 THEN $5 ELSE due_at END,
+			updated_at = now()
 		 WHERE id=$1
-		 RETURNING id, column_id, title, description, position, created_at`,
-		id, title, description,
-	).Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt)
-	return c, err
+		 RETURNING id, column_id, title, description, position, created_at, updated_at, due_at`,
+		id, u.Title, u.Description, u.SetDueAt, u.DueAt,
+	).Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt, &c.UpdatedAt, &c.DueAt)
+	if err != nil {
+		return nil, err
+	}
+	// A PATCH that changes nothing is not an edit worth reporting.
+	var a *Activity
+	if u.Title != nil || u.Description != nil || u.SetDueAt {
+		if a, err = s.recordActivity(ctx, tx, c.ID, ActivityUpdated, ""); err != nil {
+			return nil, err
+		}
+	}
+	return c, s.commit(tx, a)
 }
 
 func (s *Store) DeleteCard(ctx context.Context, id string) error {
@@ -222,6 +287,34 @@ func (s *Store) DeleteCard(ctx context.Context, id string) error {
 	return err
 }
 
+// EachBoardCard calls fn for every card on a board, ordered by column and
+// card position. Rows are streamed so large boards are never held in memory.
+func (s *Store) EachBoardCard(ctx context.Context, boardID string, fn func(columnName string, c Card) error) error {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT bc.name, c.id, c.column_id, c.title, c.description, c.position, c.created_at, c.updated_at, c.due_at
+		 FROM cards c
+		 JOIN board_columns bc ON bc.id = c.column_id
+		 WHERE bc.board_id=$1
+		 ORDER BY bc.position, c.position`, boardID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var columnName string
+		var c Card
+		if err := rows.Scan(&columnName, &c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt, &c.UpdatedAt, &c.DueAt); err != nil {
+			return err
+		}
+		if err := fn(columnName, c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 // CardOwner checks card belongs to user's board
 func (s *Store) CardOwner(ctx context.Context, cardID, userID string) error {
 	var exists bool
@@ -306,6 +399,14 @@ func (s *Store) MoveCard(ctx context.Context, cardID, targetColumnID string, tar
 		return nil, err
 	}
 
+	var srcColumnName string
+	err = tx.QueryRowContext(ctx,
+		`SELECT name FROM board_columns WHERE id=$1`, srcColumnID,
+	).Scan(&srcColumnName)
+	if err != nil {
+		return nil, err
+	}
+
 	// Close gap in source column
 	_, err = tx.ExecContext(ctx,
 		`UPDATE cards SET position = position - 1 WHERE column_id=$1 AND position > $2`,
@@ -327,13 +428,78 @@ func (s *Store) MoveCard(ctx context.Context, cardID, targetColumnID string, tar
 	// Move card
 	c := &Card{}
 	err = tx.QueryRowContext(ctx,
-		`UPDATE cards SET column_id=$2, position=$3 WHERE id=$1
-		 RETURNING id, column_id, title, description, position, created_at`,
+		`UPDATE cards SET column_id=$2, position=$3, updated_at=now() WHERE id=$1
+		 RETURNING id, column_id, title, description, position, created_at, updated_at, due_at`,
 		cardID, targetColumnID, targetPosition,
-	).Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt)
+	).Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt, &c.UpdatedAt, &c.DueAt)
 	if err != nil {
 		return nil, err
 	}
 
-	return c, tx.Commit()
+	a, err := s.recordActivity(ctx, tx, c.ID, ActivityMoved, srcColumnName)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, s.commit(tx, a)
+}
+
+// Activity
+
+// recordActivity appends an entry to the board's activity log, snapshotting
+// the card's current title and column so the entry survives later edits.
+func (s *Store) recordActivity(ctx context.Context, tx *sql.Tx, cardID, kind, fromColumn string) (*Activity, error) {
+	a := &Activity{}
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO card_activity (board_id, card_id, kind, card_title, column_name, from_column_name)
+		 SELECT bc.board_id, c.id, $2, c.title, bc.name, $3
+		 FROM cards c JOIN board_columns bc ON bc.id = c.column_id
+		 WHERE c.id=$1
+		 RETURNING id, board_id, card_id, kind, card_title, column_name, from_column_name, created_at`,
+		cardID, kind, fromColumn,
+	).Scan(&a.ID, &a.BoardID, &a.CardID, &a.Kind, &a.CardTitle, &a.ColumnName, &a.FromColumnName, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if s.OnActivity != nil {
+		if err := s.OnActivity(ctx, tx, *a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// commit commits tx, then hands the activity it recorded, if any, to
+// AfterActivity.
+func (s *Store) commit(tx *sql.Tx, a *Activity) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if a != nil && s.AfterActivity != nil {
+		s.AfterActivity(*a)
+	}
+	return nil
+}
+
+// ListActivity returns the most recent activity on a board, newest first.
+func (s *Store) ListActivity(ctx context.Context, boardID string, limit int) ([]Activity, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, board_id, card_id, kind, card_title, column_name, from_column_name, created_at
+		 FROM card_activity WHERE board_id=$1 ORDER BY created_at DESC LIMIT $2`,
+		boardID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activity := []Activity{}
+	for rows.Next() {
+		var a Activity
+		if err := rows.Scan(&a.ID, &a.BoardID, &a.CardID, &a.Kind, &a.CardTitle, &a.ColumnName, &a.FromColumnName, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
 }
@@ -3,10 +3,17 @@ package board
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"trello-clone/internal/auth"
 	"trello-clone/internal/testutil"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func createUser(t *testing.T, db *sql.DB, email string) *auth.User {
@@ -114,6 +121,37 @@ func TestGetBoard(t *testing.T) {
 	}
 }
 
+func TestGetBoardTraced(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	u := createUser(t, db, "traced@example.com")
+	b, _ := s.CreateBoard(context.Background(), u.ID, "Traced")
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "GET /api/boards/{id}")
+	if _, err := s.GetBoard(ctx, b.ID, u.ID); err != nil {
+		t.Fatalf("get board: %v", err)
+	}
+	parent.End()
+
+	var queries int
+	for _, span := range rec.Ended() {
+		if span.Parent().SpanID() == parent.SpanContext().SpanID() {
+			queries++
+			if span.Name() != "SELECT" {
+				t.Errorf("query span %q", span.Name())
+			}
+		}
+	}
+	if queries == 0 {
+		t.Fatal("no query spans under the request span")
+	}
+}
+
 func TestGetBoardWrongUser(t *testing.T) {
 	db := testutil.SetupDB(t)
 	s := &Store{DB: db}
@@ -128,6 +166,26 @@ func TestGetBoardWrongUser(t *testing.T) {
 	}
 }
 
+func TestBoardSummary(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	u1 := createUser(t, db, "summary@example.com")
+	u2 := createUser(t, db, "nosy@example.com")
+	ctx := context.Background()
+
+	b, _ := s.CreateBoard(ctx, u1.ID, "Summed Up")
+	got, err := s.BoardSummary(ctx, b.ID, u1.ID)
+	if err != nil {
+		t.Fatalf("board summary: %v", err)
+	}
+	if got.Name != "Summed Up" || got.Columns != nil {
+		t.Fatalf("summary = %+v, want the name and no columns", got)
+	}
+	if _, err := s.BoardSummary(ctx, b.ID, u2.ID); err == nil {
+		t.Fatal("expected error for wrong user")
+	}
+}
+
 func TestDeleteBoard(t *testing.T) {
 	db := testutil.SetupDB(t)
 	s := &Store{DB: db}
@@ -299,7 +357,7 @@ func TestUpdateCard(t *testing.T) {
 	card, _ := s.CreateCard(ctx, col.ID, "Original", "Orig desc")
 	newTitle := "Updated"
 	newDesc := "New desc"
-	updated, err := s.UpdateCard(ctx, card.ID, &newTitle, &newDesc)
+	updated, err := s.UpdateCard(ctx, card.ID, CardUpdate{Title: &newTitle, Description: &newDesc})
 	if err != nil {
 		t.Fatalf("update card: %v", err)
 	}
@@ -465,3 +523,123 @@ func TestMoveCardAcrossColumns(t *testing.T) {
 		t.Fatalf("d0 position = %d, want 1", dstPositions[d0.ID])
 	}
 }
+
+func TestEachBoardCard(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	u := createUser(t, db, "each@example.com")
+	ctx := context.Background()
+
+	b, _ := s.CreateBoard(ctx, u.ID, "Board")
+	full, _ := s.GetBoard(ctx, b.ID, u.ID)
+	s.CreateCard(ctx, full.Columns[1].ID, "Doing 1", "")
+	s.CreateCard(ctx, full.Columns[0].ID, "Todo 1", "")
+	s.CreateCard(ctx, full.Columns[0].ID, "Todo 2", "")
+
+	var got []string
+	err := s.EachBoardCard(ctx, b.ID, func(columnName string, c Card) error {
+		got = append(got, columnName+"/"+c.Title)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("each board card: %v", err)
+	}
+	want := []string{"Todo/Todo 1", "Todo/Todo 2", "Doing/Doing 1"}
+	if len(got) != len(want) {
+		t.Fatalf("cards = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("cards = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestUpdateCardDueAt(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	u := createUser(t, db, "due@example.com")
+	ctx := context.Background()
+
+	b, _ := s.CreateBoard(ctx, u.ID, "Board")
+	full, _ := s.GetBoard(ctx, b.ID, u.ID)
+	card, _ := s.CreateCard(ctx, full.Columns[0].ID, "Due", "")
+	if card.DueAt != nil {
+		t.Fatal("new card should have no due date")
+	}
+
+	due := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated, err := s.UpdateCard(ctx, card.ID, CardUpdate{SetDueAt: true, DueAt: &due})
+	if err != nil {
+		t.Fatalf("set due: %v", err)
+	}
+	if updated.DueAt == nil || !updated.DueAt.Equal(due) {
+		t.Fatalf("due_at = %v, want %v", updated.DueAt, due)
+	}
+
+	cleared, err := s.UpdateCard(ctx, card.ID, CardUpdate{SetDueAt: true})
+	if err != nil {
+		t.Fatalf("clear due: %v", err)
+	}
+	if cleared.DueAt != nil {
+		t.Fatalf("due_at = %v, want nil", cleared.DueAt)
+	}
+}
+
+func TestListActivity(t *testing.T) {
+	db := testutil.SetupDB(t)
+	s := &Store{DB: db}
+	u := createUser(t, db, "activity@example.com")
+	ctx := context.Background()
+
+	b, _ := s.CreateBoard(ctx, u.ID, "Board")
+	full, _ := s.GetBoard(ctx, b.ID, u.ID)
+	card, _ := s.CreateCard(ctx, full.Columns[0].ID, "Tracked", "")
+	newTitle := "Tracked v2"
+	s.UpdateCard(ctx, card.ID, CardUpdate{Title: &newTitle})
+	s.MoveCard(ctx, card.ID, full.Columns[2].ID, 0)
+
+	activity, err := s.ListActivity(ctx, b.ID, 10)
+	if err != nil {
+		t.Fatalf("list activity: %v", err)
+	}
+	if len(activity) != 3 {
+		t.Fatalf("activity = %d, want 3", len(activity))
+	}
+	// Newest first
+	moved := activity[0]
+	if moved.Kind != ActivityMoved || moved.FromColumnName != "Todo" || moved.ColumnName != "Done" {
+		t.Fatalf("moved = %+v, want Todo -> Done move", moved)
+	}
+	if moved.CardTitle != "Tracked v2" {
+		t.Fatalf("card_title = %q, want Tracked v2", moved.CardTitle)
+	}
+	if activity[2].Kind != ActivityCreated {
+		t.Fatalf("oldest kind = %q, want %q", activity[2].Kind, ActivityCreated)
+	}
+}
+
+func TestAfterActivity(t *testing.T) {
+	db := testutil.SetupDB(t)
+	var after []string
+	s := &Store{DB: db, AfterActivity: func(a Activity) { after = append(after, a.Kind) }}
+	u := createUser(t, db, "after@example.com")
+	ctx := context.Background()
+
+	b, _ := s.CreateBoard(ctx, u.ID, "Board")
+	full, _ := s.GetBoard(ctx, b.ID, u.ID)
+	card, _ := s.CreateCard(ctx, full.Columns[0].ID, "Counted", "")
+	s.UpdateCard(ctx, card.ID, CardUpdate{}) // no change, no activity
+	if len(after) != 1 || after[0] != ActivityCreated {
+		t.Fatalf("after = %v, want [%s]", after, ActivityCreated)
+	}
+
+	// A change that rolls back is not reported.
+	s.OnActivity = func(context.Context, *sql.Tx, Activity) error { return errors.New("outbox down") }
+	if _, err := s.MoveCard(ctx, card.ID, full.Columns[1].ID, 0); err == nil {
+		t.Fatal("move succeeded despite OnActivity failing")
+	}
+	if len(after) != 1 {
+		t.Fatalf("after = %v, want the rolled back move left out", after)
+	}
+}
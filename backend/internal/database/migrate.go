@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"embed"
 	"fmt"
-	"log"
+	"log/slog"
 	"sort"
 )
 
@@ -61,8 +61,42 @@ func Migrate(ctx context.Context, db *sql.DB) error {
 		if err := tx.Commit(); err != nil {
 			return fmt.Errorf("commit migration %s: %w", name, err)
 		}
-		log.Printf("applied migration: %s", name)
+		slog.InfoContext(ctx, "applied migration", "name", name)
 	}
 
 	return nil
 }
+
+// PendingMigrations returns the embedded migrations that have not been
+// applied to db, in order.
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("list applied migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := map[string]bool{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := migrationFS.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations dir: %w", err)
+	}
+	var pending []string
+	for _, e := range entries {
+		if !applied[e.Name()] {
+			pending = append(pending, e.Name())
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
@@ -0,0 +1,3 @@
+ALTER TABLE cards ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_cards_due_at ON cards(due_at) WHERE due_at IS NOT NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS feed_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    board_id UUID REFERENCES boards(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE NULLS NOT DISTINCT (user_id, board_id, kind)
+);
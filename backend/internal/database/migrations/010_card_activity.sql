@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS card_activity (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    board_id UUID NOT NULL REFERENCES boards(id) ON DELETE CASCADE,
+    card_id UUID NOT NULL,
+    kind TEXT NOT NULL,
+    card_title TEXT NOT NULL,
+    column_name TEXT NOT NULL,
+    from_column_name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_card_activity_board_id ON card_activity(board_id, created_at DESC);
@@ -0,0 +1,19 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+-- Accounts created through OAuth got their address from the provider.
+UPDATE users SET email_verified_at = created_at
+WHERE email_verified_at IS NULL AND password_hash = ''
+  AND EXISTS (SELECT 1 FROM oauth_accounts WHERE oauth_accounts.user_id = users.id);
+
+-- A token verifies the address it was sent to, not whatever the user's
+-- address is when it is used.
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id ON email_verification_tokens(user_id);
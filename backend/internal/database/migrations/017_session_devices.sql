@@ -0,0 +1,23 @@
+-- Sessions were keyed by their plaintext token. Store only its SHA-256 hash
+-- (as auth.HashToken computes it) so existing logins keep working, and give
+-- each session an id that can be shown and revoked.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS id UUID NOT NULL DEFAULT gen_random_uuid();
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS token_hash TEXT;
+-- The backfill reads the column it then drops, so only run it while the
+-- column is still there; migrations must be safe to apply twice.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'sessions' AND column_name = 'token') THEN
+        UPDATE sessions SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex');
+        ALTER TABLE sessions ALTER COLUMN token_hash SET NOT NULL;
+        ALTER TABLE sessions DROP CONSTRAINT IF EXISTS sessions_pkey;
+        ALTER TABLE sessions DROP COLUMN token;
+        ALTER TABLE sessions ADD PRIMARY KEY (id);
+    END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_token_hash ON sessions(token_hash);
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now();
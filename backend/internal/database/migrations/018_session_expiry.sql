@@ -0,0 +1,5 @@
+-- expires_at now slides forward with activity (idle timeout);
+-- absolute_expires_at caps the session's lifetime however active it is.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS absolute_expires_at TIMESTAMPTZ;
+UPDATE sessions SET absolute_expires_at = expires_at WHERE absolute_expires_at IS NULL;
+ALTER TABLE sessions ALTER COLUMN absolute_expires_at SET NOT NULL;
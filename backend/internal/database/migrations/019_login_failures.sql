@@ -0,0 +1,10 @@
+-- Failed password logins, counted per client IP and per account email, so
+-- Login can lock out guessing with increasing delays.
+CREATE TABLE IF NOT EXISTS login_failures (
+    scope           TEXT NOT NULL,
+    subject         TEXT NOT NULL,
+    failures        INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until    TIMESTAMPTZ,
+    PRIMARY KEY (scope, subject)
+);
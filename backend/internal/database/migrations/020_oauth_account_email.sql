@@ -0,0 +1,3 @@
+-- The address the provider reported, so users can tell their linked
+-- identities apart in account settings. Refreshed on each sign-in.
+ALTER TABLE oauth_accounts ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,11 @@
+-- A requested change of address. The user's email only changes once the
+-- link sent to the new address is followed.
+CREATE TABLE IF NOT EXISTS email_changes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    new_email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_email_changes_user_id ON email_changes(user_id);
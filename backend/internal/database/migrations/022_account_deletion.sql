@@ -0,0 +1,19 @@
+-- Set while a requested account deletion waits out its grace period.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at)
+    WHERE deletion_scheduled_at IS NOT NULL;
+
+-- Audit trail of deletion requests. Rows outlive the account they describe,
+-- so user_id is not a foreign key and no personal data is kept.
+CREATE TABLE IF NOT EXISTS account_deletions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    scheduled_at TIMESTAMPTZ NOT NULL,
+    cancelled_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    boards_deleted INT
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_deletions_user_id ON account_deletions(user_id);
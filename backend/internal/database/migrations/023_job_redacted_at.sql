@@ -0,0 +1,8 @@
+-- Set when a dead job's payload was erased because it held secrets. Such a
+-- job can't be retried; a payload of null is just a job without arguments.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS redacted_at TIMESTAMPTZ;
+
+-- Dead mail erased before this column existed. Every message has a
+-- recipient, so a null payload can only mean it was erased.
+UPDATE jobs SET redacted_at = run_at
+WHERE kind = 'mail.send' AND status = 'dead' AND payload = 'null'::jsonb AND redacted_at IS NULL;
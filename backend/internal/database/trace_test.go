@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestQueryTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	qt := &queryTracer{tracer: tp.Tracer("test")}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "GET /api/boards/{id}")
+	qctx := qt.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{
+		SQL:  "\n\t\tselect id, name FROM boards WHERE id=$1",
+		Args: []any{"secret-arg"},
+	})
+	qt.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+	qctx = qt.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "DELETE FROM cards WHERE id=$1"})
+	qt.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{Err: errors.New("boom")})
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("spans = %d, want 3", len(spans))
+	}
+	sel, del := spans[0], spans[1]
+	if sel.Name() != "SELECT" || sel.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("span = %s (%s)", sel.Name(), sel.SpanKind())
+	}
+	if sel.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("query span is not a child of the request span")
+	}
+	attrs := map[string]string{}
+	for _, kv := range sel.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["db.system.name"] != "postgresql" || attrs["db.query.text"] == "" {
+		t.Fatalf("attributes = %v", attrs)
+	}
+	for _, v := range attrs {
+		if v == "secret-arg" {
+			t.Fatal("query arguments recorded")
+		}
+	}
+	if del.Name() != "DELETE" || del.Status().Code != codes.Error {
+		t.Fatalf("failed query: %s, status %v", del.Name(), del.Status())
+	}
+}
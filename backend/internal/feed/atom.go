@@ -0,0 +1,98 @@
+package feed
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+	"trello-clone/internal/board"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link,omitempty"`
+	Summary string     `xml:"summary"`
+}
+
+// activityTitle describes an activity entry in a single line.
+func activityTitle(a board.Activity) string {
+	switch a.Kind {
+	case board.ActivityCreated:
+		return "Card created: " + a.CardTitle
+	case board.ActivityMoved:
+		return "Card moved: " + a.CardTitle
+	default:
+		return "Card edited: " + a.CardTitle
+	}
+}
+
+func activitySummary(a board.Activity) string {
+	switch a.Kind {
+	case board.ActivityCreated:
+		return "\"" + a.CardTitle + "\" was added to " + a.ColumnName + "."
+	case board.ActivityMoved:
+		return "\"" + a.CardTitle + "\" was moved from " + a.FromColumnName + " to " + a.ColumnName + "."
+	default:
+		return "\"" + a.CardTitle + "\" was edited in " + a.ColumnName + "."
+	}
+}
+
+// writeAtom renders a board's activity as an Atom 1.0 (RFC 4287) feed.
+// selfURL is the feed's own URL; boardURL, if set, is linked from the feed
+// and every entry.
+func writeAtom(w io.Writer, b *board.Board, activity []board.Activity, selfURL, boardURL string) error {
+	updated := b.CreatedAt
+	if len(activity) > 0 {
+		updated = activity[0].CreatedAt
+	}
+
+	f := atomFeed{
+		ID:      "urn:uuid:" + b.ID,
+		Title:   b.Name + " activity",
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Href: selfURL}},
+		Author:  atomAuthor{Name: "FlowBoard"},
+	}
+	if boardURL != "" {
+		f.Links = append(f.Links, atomLink{Rel: "alternate", Href: boardURL})
+	}
+	for _, a := range activity {
+		e := atomEntry{
+			ID:      "urn:uuid:" + a.ID,
+			Title:   activityTitle(a),
+			Updated: a.CreatedAt.UTC().Format(time.RFC3339),
+			Summary: activitySummary(a),
+		}
+		if boardURL != "" {
+			e.Links = []atomLink{{Rel: "alternate", Href: boardURL}}
+		}
+		f.Entries = append(f.Entries, e)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(f)
+}
@@ -0,0 +1,48 @@
+package feed
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"trello-clone/internal/board"
+)
+
+func TestWriteAtom(t *testing.T) {
+	at := time.Date(2025, 5, 6, 7, 8, 9, 0, time.UTC)
+	b := &board.Board{ID: "b1", Name: "Roadmap", CreatedAt: at.Add(-time.Hour)}
+	activity := []board.Activity{
+		{ID: "a2", Kind: board.ActivityMoved, CardTitle: "Login <page>", ColumnName: "Done", FromColumnName: "Doing", CreatedAt: at},
+		{ID: "a1", Kind: board.ActivityCreated, CardTitle: "Login <page>", ColumnName: "Todo", CreatedAt: at.Add(-time.Minute)},
+	}
+
+	var sb strings.Builder
+	if err := writeAtom(&sb, b, activity, "http://api/feed.atom", "http://app/boards/b1"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var f atomFeed
+	if err := xml.Unmarshal([]byte(sb.String()), &f); err != nil {
+		t.Fatalf("output is not valid XML: %v\n%s", err, sb.String())
+	}
+	if f.Title != "Roadmap activity" {
+		t.Fatalf("title = %q", f.Title)
+	}
+	if f.Updated != "2025-05-06T07:08:09Z" {
+		t.Fatalf("updated = %q, want newest entry time", f.Updated)
+	}
+	if len(f.Entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(f.Entries))
+	}
+	e := f.Entries[0]
+	if e.Title != "Card moved: Login <page>" {
+		t.Fatalf("entry title = %q", e.Title)
+	}
+	if !strings.Contains(e.Summary, "from Doing to Done") {
+		t.Fatalf("entry summary = %q", e.Summary)
+	}
+	if len(e.Links) != 1 || e.Links[0].Href != "http://app/boards/b1" {
+		t.Fatalf("entry links = %+v, want link back to board", e.Links)
+	}
+}
@@ -0,0 +1,171 @@
+package feed
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"trello-clone/internal/auth"
+	"trello-clone/internal/board"
+	"trello-clone/internal/httputil"
+)
+
+type Handler struct {
+	Store  *Store
+	Boards *board.Store
+	// APIURL is the public base URL of this server, used to build feed URLs.
+	APIURL string
+	// AppURL is the frontend origin, used for links back to boards.
+	AppURL string
+}
+
+func (h *Handler) calendarURL(token string) string {
+	return h.APIURL + "/api/feeds/calendar/" + token + ".ics"
+}
+
+func (h *Handler) activityURL(token string) string {
+	return h.APIURL + "/api/feeds/activity/" + token + ".atom"
+}
+
+// Tokens (require session)
+
+func (h *Handler) RotateUserCalendarToken(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	token, err := h.Store.RotateToken(r.Context(), u.ID, "", KindCalendar)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to create feed token")
+		return
+	}
+	httputil.JSON(w, http.StatusCreated, map[string]string{"url": h.calendarURL(token)})
+}
+
+func (h *Handler) RevokeUserCalendarToken(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	if err := h.Store.RevokeToken(r.Context(), u.ID, "", KindCalendar); err != nil {
+		httputil.Error(w, http.StatusNotFound, "feed token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) RotateBoardCalendarToken(w http.ResponseWriter, r *http.Request) {
+	h.rotateBoardToken(w, r, KindCalendar, h.calendarURL)
+}
+
+func (h *Handler) RevokeBoardCalendarToken(w http.ResponseWriter, r *http.Request) {
+	h.revokeBoardToken(w, r, KindCalendar)
+}
+
+func (h *Handler) RotateBoardActivityToken(w http.ResponseWriter, r *http.Request) {
+	h.rotateBoardToken(w, r, KindActivity, h.activityURL)
+}
+
+func (h *Handler) RevokeBoardActivityToken(w http.ResponseWriter, r *http.Request) {
+	h.revokeBoardToken(w, r, KindActivity)
+}
+
+func (h *Handler) rotateBoardToken(w http.ResponseWriter, r *http.Request, kind string, feedURL func(string) string) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if _, err := h.Boards.BoardSummary(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "board not found")
+		return
+	}
+
+	token, err := h.Store.RotateToken(r.Context(), u.ID, id, kind)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to create feed token")
+		return
+	}
+	httputil.JSON(w, http.StatusCreated, map[string]string{"url": feedURL(token)})
+}
+
+func (h *Handler) revokeBoardToken(w http.ResponseWriter, r *http.Request, kind string) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if err := h.Store.RevokeToken(r.Context(), u.ID, id, kind); err != nil {
+		httputil.Error(w, http.StatusNotFound, "feed token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Feeds (authorized by token in the URL, no session)
+
+// Calendar serves the iCalendar feed for the token in the path. Cards are
+// emitted as VEVENTs unless ?component=vtodo is given.
+func (h *Handler) Calendar(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(r.PathValue("token"), ".ics")
+	t, err := h.Store.TokenByValue(r.Context(), token, KindCalendar)
+	if err != nil {
+		httputil.Error(w, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	component := "VEVENT"
+	if strings.EqualFold(r.URL.Query().Get("component"), "vtodo") {
+		component = "VTODO"
+	}
+
+	cards, err := h.Store.DueCards(r.Context(), t.UserID, t.BoardID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to load cards")
+		return
+	}
+
+	name := "FlowBoard"
+	if t.BoardID != "" {
+		b, err := h.Boards.BoardSummary(r.Context(), t.BoardID, t.UserID)
+		if err != nil {
+			httputil.Error(w, http.StatusNotFound, "feed not found")
+			return
+		}
+		name = b.Name
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	if err := writeCalendar(w, name, component, h.AppURL, cards, time.Now()); err != nil {
+		// Headers are already sent at this point, so all we can do is log.
+		slog.ErrorContext(r.Context(), "calendar feed", "board_id", t.BoardID, "error", err)
+	}
+}
+
+// activityFeedSize is the number of most recent entries in an activity feed.
+const activityFeedSize = 50
+
+// Activity serves the Atom feed of recent card activity on the token's board.
+func (h *Handler) Activity(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(r.PathValue("token"), ".atom")
+	t, err := h.Store.TokenByValue(r.Context(), token, KindActivity)
+	if err != nil {
+		httputil.Error(w, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	b, err := h.Boards.BoardSummary(r.Context(), t.BoardID, t.UserID)
+	if err != nil {
+		httputil.Error(w, http.StatusNotFound, "feed not found")
+		return
+	}
+
+	activity, err := h.Boards.ListActivity(r.Context(), b.ID, activityFeedSize)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to load activity")
+		return
+	}
+
+	var boardURL string
+	if h.AppURL != "" {
+		boardURL = h.AppURL + "/boards/" + b.ID
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	if err := writeAtom(w, b, activity, h.activityURL(token), boardURL); err != nil {
+		// Headers are already sent at this point, so all we can do is log.
+		slog.ErrorContext(r.Context(), "activity feed", "board_id", b.ID, "error", err)
+	}
+}
@@ -0,0 +1,194 @@
+package feed_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"trello-clone/internal/server"
+	"trello-clone/internal/testutil"
+)
+
+// newServer builds the server under test.
+func newServer(t *testing.T, cfg server.Config) *http.Server {
+	t.Helper()
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	return srv
+}
+
+func signupAndGetCookie(t *testing.T, srv *http.Server) *http.Cookie {
+	t.Helper()
+	body := `{"email":"feed@example.com","password":"password123","name":"Feed User"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/signup", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signup: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session" {
+			return c
+		}
+	}
+	t.Fatal("no session cookie after signup")
+	return nil
+}
+
+func doRequest(t *testing.T, srv *http.Server, method, path string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, r)
+	return w
+}
+
+// createDueCard creates a board with one card due at the given time and
+// returns the board ID.
+func createDueCard(t *testing.T, srv *http.Server, cookie *http.Cookie, title, dueAt string) string {
+	t.Helper()
+	cw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Feed Board"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(cw.Body.Bytes(), &board)
+	boardID := board["id"].(string)
+
+	gw := doRequest(t, srv, http.MethodGet, "/api/boards/"+boardID, "", cookie)
+	var fullBoard map[string]any
+	json.Unmarshal(gw.Body.Bytes(), &fullBoard)
+	colID := fullBoard["columns"].([]any)[0].(map[string]any)["id"].(string)
+
+	ccw := doRequest(t, srv, http.MethodPost, fmt.Sprintf("/api/columns/%s/cards", colID), fmt.Sprintf(`{"title":%q}`, title), cookie)
+	var card map[string]any
+	json.Unmarshal(ccw.Body.Bytes(), &card)
+
+	uw := doRequest(t, srv, http.MethodPatch, "/api/cards/"+card["id"].(string), fmt.Sprintf(`{"due_at":%q}`, dueAt), cookie)
+	if uw.Code != http.StatusOK {
+		t.Fatalf("set due_at: status = %d, body = %s", uw.Code, uw.Body.String())
+	}
+	return boardID
+}
+
+func feedPath(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("rotate: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	i := strings.Index(resp["url"], "/api/feeds/")
+	if i < 0 {
+		t.Fatalf("url = %q, want feed URL", resp["url"])
+	}
+	return resp["url"][i:]
+}
+
+func TestUserCalendarFeed(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db, BaseURL: "http://api.test"})
+	cookie := signupAndGetCookie(t, srv)
+	createDueCard(t, srv, cookie, "Release", "2030-01-02T15:04:05Z")
+
+	path := feedPath(t, doRequest(t, srv, http.MethodPost, "/api/feeds/calendar/token", "", cookie))
+
+	// No cookie: the token alone authorizes the feed.
+	w := doRequest(t, srv, http.MethodGet, path, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Fatalf("content-type = %q, want text/calendar", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "SUMMARY:Release\r\n") || !strings.Contains(body, "DTSTART:20300102T150405Z\r\n") {
+		t.Fatalf("feed missing card:\n%s", body)
+	}
+}
+
+func TestCalendarFeedRotateAndRevoke(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+	cookie := signupAndGetCookie(t, srv)
+	boardID := createDueCard(t, srv, cookie, "Board card", "2030-01-02T15:04:05Z")
+
+	tokenPath := "/api/boards/" + boardID + "/feeds/calendar/token"
+	oldPath := feedPath(t, doRequest(t, srv, http.MethodPost, tokenPath, "", cookie))
+	newPath := feedPath(t, doRequest(t, srv, http.MethodPost, tokenPath, "", cookie))
+
+	if w := doRequest(t, srv, http.MethodGet, oldPath, "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("rotated token: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := doRequest(t, srv, http.MethodGet, newPath, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("new token: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if w := doRequest(t, srv, http.MethodDelete, tokenPath, "", cookie); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := doRequest(t, srv, http.MethodGet, newPath, "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("revoked token: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCalendarFeedUnknownToken(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+
+	w := doRequest(t, srv, http.MethodGet, "/api/feeds/calendar/nope.ics", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestActivityFeed(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db, AllowOrigin: "http://app.test"})
+	cookie := signupAndGetCookie(t, srv)
+	boardID := createDueCard(t, srv, cookie, "Tracked card", "2030-01-02T15:04:05Z")
+
+	tokenPath := "/api/boards/" + boardID + "/feeds/activity/token"
+	path := feedPath(t, doRequest(t, srv, http.MethodPost, tokenPath, "", cookie))
+
+	w := doRequest(t, srv, http.MethodGet, path, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body = %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+		t.Fatalf("content-type = %q, want application/atom+xml", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "Card created: Tracked card") {
+		t.Fatalf("feed missing created entry:\n%s", body)
+	}
+	if !strings.Contains(body, "http://app.test/boards/"+boardID) {
+		t.Fatalf("feed missing link back to board:\n%s", body)
+	}
+
+	// Calendar tokens do not open activity feeds.
+	calPath := feedPath(t, doRequest(t, srv, http.MethodPost, "/api/boards/"+boardID+"/feeds/calendar/token", "", cookie))
+	calToken := strings.TrimSuffix(calPath[strings.LastIndex(calPath, "/")+1:], ".ics")
+	if w := doRequest(t, srv, http.MethodGet, "/api/feeds/activity/"+calToken+".atom", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("calendar token on activity feed: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := doRequest(t, srv, http.MethodDelete, tokenPath, "", cookie); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := doRequest(t, srv, http.MethodGet, path, "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("revoked token: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,76 @@
+package feed
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const icalTimeFormat = "20060102T150405Z"
+
+// writeCalendar renders cards as an RFC 5545 calendar. component is
+// "VEVENT" (the due date is the event start) or "VTODO" (the due date is
+// the to-do's DUE).
+func writeCalendar(w io.Writer, name, component, appURL string, cards []DueCard, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	line := func(s string) { writeFolded(bw, s) }
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//FlowBoard//Card Due Dates//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:" + escapeText(name))
+	for _, c := range cards {
+		if c.DueAt == nil {
+			continue
+		}
+		line("BEGIN:" + component)
+		line("UID:" + c.ID + "@flowboard")
+		line("DTSTAMP:" + now.UTC().Format(icalTimeFormat))
+		if component == "VTODO" {
+			line("DUE:" + c.DueAt.UTC().Format(icalTimeFormat))
+		} else {
+			line("DTSTART:" + c.DueAt.UTC().Format(icalTimeFormat))
+		}
+		line("SUMMARY:" + escapeText(c.Title))
+		if c.Description != "" {
+			line("DESCRIPTION:" + escapeText(c.Description))
+		}
+		line("CATEGORIES:" + escapeText(c.BoardName) + "," + escapeText(c.ColumnName))
+		if appURL != "" {
+			line("URL:" + appURL + "/boards/" + c.BoardID)
+		}
+		line("LAST-MODIFIED:" + c.UpdatedAt.UTC().Format(icalTimeFormat))
+		line("END:" + component)
+	}
+	line("END:VCALENDAR")
+	return bw.Flush()
+}
+
+// escapeText escapes a TEXT property value (RFC 5545 section 3.3.11).
+func escapeText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// writeFolded writes a content line terminated by CRLF, folding it so no
+// physical line exceeds 75 octets. Folds never split a UTF-8 sequence.
+func writeFolded(w *bufio.Writer, s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.WriteString(s[:cut])
+		w.WriteString("\r\n ")
+		s = s[cut:]
+		// Continuation lines start with a space, which counts toward the limit.
+		limit = 74
+	}
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
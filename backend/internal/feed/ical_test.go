@@ -0,0 +1,103 @@
+package feed
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"trello-clone/internal/board"
+)
+
+func TestWriteCalendar(t *testing.T) {
+	due := time.Date(2025, 3, 14, 9, 30, 0, 0, time.FixedZone("CET", 3600))
+	updated := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Date(2025, 3, 2, 8, 0, 0, 0, time.UTC)
+	cards := []DueCard{{
+		Card: board.Card{
+			ID:          "card-1",
+			Title:       "Ship it; finally, really",
+			Description: "line one\nline two",
+			UpdatedAt:   updated,
+			DueAt:       &due,
+		},
+		BoardID:    "board-1",
+		BoardName:  "Sprint",
+		ColumnName: "Doing",
+	}, {
+		Card: board.Card{ID: "no-due", Title: "Skipped"},
+	}}
+
+	var sb strings.Builder
+	if err := writeCalendar(&sb, "Sprint", "VEVENT", "http://app", cards, now); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	out := sb.String()
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"VERSION:2.0\r\n",
+		"UID:card-1@flowboard\r\n",
+		"DTSTAMP:20250302T080000Z\r\n",
+		"DTSTART:20250314T083000Z\r\n",
+		"SUMMARY:Ship it\\; finally\\, really\r\n",
+		"DESCRIPTION:line one\\nline two\r\n",
+		"URL:http://app/boards/board-1\r\n",
+		"LAST-MODIFIED:20250301T120000Z\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("calendar missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Skipped") {
+		t.Fatal("cards without due date should be skipped")
+	}
+	if strings.Count(out, "BEGIN:VEVENT") != 1 {
+		t.Fatalf("expected exactly one VEVENT:\n%s", out)
+	}
+}
+
+func TestWriteCalendarVTODO(t *testing.T) {
+	due := time.Date(2025, 3, 14, 9, 30, 0, 0, time.UTC)
+	cards := []DueCard{{Card: board.Card{ID: "c", Title: "T", DueAt: &due}}}
+
+	var sb strings.Builder
+	writeCalendar(&sb, "x", "VTODO", "", cards, due)
+	out := sb.String()
+	if !strings.Contains(out, "BEGIN:VTODO\r\n") || !strings.Contains(out, "DUE:20250314T093000Z\r\n") {
+		t.Fatalf("expected VTODO with DUE:\n%s", out)
+	}
+	if strings.Contains(out, "DTSTART") {
+		t.Fatalf("VTODO should not carry DTSTART:\n%s", out)
+	}
+}
+
+func TestWriteFolded(t *testing.T) {
+	var sb strings.Builder
+	bw := bufio.NewWriter(&sb)
+	long := "SUMMARY:" + strings.Repeat("ä", 100)
+	writeFolded(bw, long)
+	bw.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(sb.String(), "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected folded output, got %q", sb.String())
+	}
+	var joined strings.Builder
+	for i, l := range lines {
+		if len(l) > 75 {
+			t.Fatalf("line %d is %d octets, want <= 75", i, len(l))
+		}
+		if i > 0 {
+			if l[0] != ' ' {
+				t.Fatalf("continuation line %d must start with a space", i)
+			}
+			l = l[1:]
+		}
+		joined.WriteString(l)
+	}
+	if joined.String() != long {
+		t.Fatal("unfolded output does not match input")
+	}
+}
@@ -0,0 +1,116 @@
+package feed
+
+import (
+	"context"
+	"database/sql"
+	"time"
+	"trello-clone/internal/auth"
+	"trello-clone/internal/board"
+)
+
+// Feed token kinds. Each user has at most one token per kind and board
+// (or per kind with no board for user-wide feeds).
+const (
+	KindCalendar = "calendar"
+	KindActivity = "activity"
+)
+
+type Token struct {
+	ID        string
+	UserID    string
+	BoardID   string // empty for user-wide feeds
+	Kind      string
+	CreatedAt time.Time
+}
+
+// DueCard is a card with a due date together with where it lives.
+type DueCard struct {
+	board.Card
+	BoardID    string
+	BoardName  string
+	ColumnName string
+}
+
+type Store struct {
+	DB *sql.DB
+}
+
+// RotateToken issues a new token for the feed, replacing any previous one.
+// Only the hash is stored; the returned plaintext is the only copy.
+func (s *Store) RotateToken(ctx context.Context, userID, boardID, kind string) (string, error) {
+	token, err := auth.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.DB.ExecContext(ctx,
+		`INSERT INTO feed_tokens (user_id, board_id, kind, token_hash)
+		 VALUES ($1, NULLIF($2, '')::uuid, $3, $4)
+		 ON CONFLICT (user_id, board_id, kind)
+		 DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = now()`,
+		userID, boardID, kind, auth.HashToken(token),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *Store) RevokeToken(ctx context.Context, userID, boardID, kind string) error {
+	res, err := s.DB.ExecContext(ctx,
+		`DELETE FROM feed_tokens
+		 WHERE user_id=$1 AND board_id IS NOT DISTINCT FROM NULLIF($2, '')::uuid AND kind=$3`,
+		userID, boardID, kind,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) TokenByValue(ctx context.Context, token, kind string) (*Token, error) {
+	t := &Token{}
+	var boardID sql.NullString
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT id, user_id, board_id, kind, created_at FROM feed_tokens WHERE token_hash=$1 AND kind=$2`,
+		auth.HashToken(token), kind,
+	).Scan(&t.ID, &t.UserID, &boardID, &t.Kind, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.BoardID = boardID.String
+	return t, nil
+}
+
+// DueCards lists cards with a due date on the user's boards, limited to a
+// single board when boardID is set.
+func (s *Store) DueCards(ctx context.Context, userID, boardID string) ([]DueCard, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT c.id, c.column_id, c.title, c.description, c.position, c.created_at, c.updated_at, c.due_at,
+		        b.id, b.name, bc.name
+		 FROM cards c
+		 JOIN board_columns bc ON bc.id = c.column_id
+		 JOIN boards b ON b.id = bc.board_id
+		 WHERE b.user_id=$1 AND ($2 = '' OR b.id::text = $2) AND c.due_at IS NOT NULL
+		 ORDER BY c.due_at`,
+		userID, boardID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []DueCard{}
+	for rows.Next() {
+		var c DueCard
+		if err := rows.Scan(&c.ID, &c.ColumnID, &c.Title, &c.Description, &c.Position, &c.CreatedAt, &c.UpdatedAt, &c.DueAt,
+			&c.BoardID, &c.BoardName, &c.ColumnName); err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
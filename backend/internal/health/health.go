@@ -0,0 +1,232 @@
+// Package health serves the liveness and readiness probes. Liveness only
+// says the process is up; readiness checks the database, the schema and
+// the background workers, and fails once shutdown begins so load balancers
+// stop sending traffic before the server stops accepting it. The public
+// probes only answer with a status; ReadyDetails reports each check and is
+// meant for the metrics listener.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"trello-clone/internal/database"
+	"trello-clone/internal/httputil"
+)
+
+// WorkerStatus is a background worker's state as reported by ReadyDetails.
+type WorkerStatus struct {
+	Running bool `json:"running"`
+	// Workers is the number of concurrent workers.
+	Workers     int        `json:"workers,omitempty"`
+	StartedAt   *time.Time `json:"started_at"`
+	LastPollAt  *time.Time `json:"last_poll_at"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Worker is a background worker that reports its state.
+type Worker interface {
+	Status() WorkerStatus
+}
+
+// Tracker records a worker's state for its Status method. The zero value
+// is a worker that hasn't started.
+type Tracker struct {
+	mu     sync.Mutex
+	status WorkerStatus
+}
+
+// Start marks the worker as running with n concurrent workers.
+func (t *Tracker) Start(n int) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = WorkerStatus{Running: true, Workers: n, StartedAt: &now}
+}
+
+// Stop marks the worker as stopped, keeping the rest of its state.
+func (t *Tracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Running = false
+}
+
+// Poll records a pass over the worker's queue and the error it ended with,
+// if any. The last error is kept until a later one replaces it.
+func (t *Tracker) Poll(err error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.LastPollAt = &now
+	if err != nil {
+		t.status.LastError = err.Error()
+		t.status.LastErrorAt = &now
+	}
+}
+
+func (t *Tracker) Status() WorkerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+type namedWorker struct {
+	name   string
+	worker Worker
+}
+
+// Checker answers the probes.
+type Checker struct {
+	DB *sql.DB
+	// Timeout bounds the database checks. Zero means 2 seconds.
+	Timeout time.Duration
+
+	workers      []namedWorker
+	shuttingDown atomic.Bool
+
+	// mu guards the result Ready reuses between probes.
+	mu        sync.Mutex
+	ready     bool
+	checkedAt time.Time
+}
+
+// readyCacheTTL is how long Ready reuses a result, so probes from anywhere
+// cost the database at most one round of checks per interval.
+const readyCacheTTL = time.Second
+
+// AddWorker adds a background worker to the readiness check. The instance
+// is not ready while any of them is stopped. Add workers before serving.
+func (c *Checker) AddWorker(name string, w Worker) {
+	c.workers = append(c.workers, namedWorker{name, w})
+}
+
+// ShutDown makes readiness fail from now on.
+func (c *Checker) ShutDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Live answers the liveness probe: if it can respond at all, the process
+// is alive. It deliberately checks nothing else, so a database outage
+// doesn't get every instance restarted.
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	httputil.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type check struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// Pending lists migrations not yet applied.
+	Pending []string `json:"pending,omitempty"`
+}
+
+type workerCheck struct {
+	Status string `json:"status"`
+	WorkerStatus
+}
+
+// Ready answers the readiness probe with 200 or 503 and a bare status. It
+// responds 503 if any check fails or the server is shutting down. The
+// checks run at most once per readyCacheTTL.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if c.shuttingDown.Load() {
+		httputil.JSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting_down"})
+		return
+	}
+
+	c.mu.Lock()
+	if time.Since(c.checkedAt) >= readyCacheTTL {
+		c.ready, _ = c.check(r.Context())
+		c.checkedAt = time.Now()
+	}
+	ready := c.ready
+	c.mu.Unlock()
+
+	if !ready {
+		httputil.JSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+		return
+	}
+	httputil.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyDetails answers like Ready, but runs every check afresh and reports
+// each one, including database errors and the workers' last errors. Serve
+// it only where the public can't reach it.
+func (c *Checker) ReadyDetails(w http.ResponseWriter, r *http.Request) {
+	ready, checks := c.check(r.Context())
+	status, code := "ok", http.StatusOK
+	switch {
+	case c.shuttingDown.Load():
+		status, code = "shutting_down", http.StatusServiceUnavailable
+	case !ready:
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	httputil.JSON(w, code, map[string]any{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// check runs every check and reports whether all of them passed.
+func (c *Checker) check(ctx context.Context) (bool, map[string]any) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ready := true
+	dbCheck := c.checkDatabase(ctx)
+	migrationsCheck := check{Status: "skipped"}
+	if dbCheck.Status == "ok" {
+		migrationsCheck = c.checkMigrations(ctx)
+	}
+	if dbCheck.Status != "ok" || migrationsCheck.Status != "ok" {
+		ready = false
+	}
+
+	workers := map[string]workerCheck{}
+	for _, nw := range c.workers {
+		s := nw.worker.Status()
+		wc := workerCheck{Status: "ok", WorkerStatus: s}
+		if !s.Running {
+			wc.Status = "stopped"
+			ready = false
+		}
+		workers[nw.name] = wc
+	}
+
+	return ready, map[string]any{
+		"database":   dbCheck,
+		"migrations": migrationsCheck,
+		"workers":    workers,
+	}
+}
+
+func (c *Checker) checkDatabase(ctx context.Context) check {
+	start := time.Now()
+	err := c.DB.PingContext(ctx)
+	latency := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return check{Status: "error", LatencyMS: latency, Error: err.Error()}
+	}
+	return check{Status: "ok", LatencyMS: latency}
+}
+
+func (c *Checker) checkMigrations(ctx context.Context) check {
+	pending, err := database.PendingMigrations(ctx, c.DB)
+	if err != nil {
+		return check{Status: "error", Error: err.Error()}
+	}
+	if len(pending) > 0 {
+		return check{Status: "pending", Pending: pending}
+	}
+	return check{Status: "ok"}
+}
@@ -2,15 +2,20 @@ package httputil
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"reflect"
+	"strings"
 )
 
 func JSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
-		log.Printf("json encode: %v", err)
+		slog.Error("json encode", "error", err)
 	}
 }
 
@@ -18,7 +23,77 @@ func Error(w http.ResponseWriter, status int, msg string) {
 	JSON(w, status, map[string]string{"error": msg})
 }
 
+// Decode reads the request body, a single JSON value, into v. Fields v
+// doesn't have are rejected, so a misspelt field is an error rather than
+// silently ignored. Errors describe what is wrong in terms fit for the
+// client; write them with InvalidBody.
 func Decode(r *http.Request, v any) error {
 	defer r.Body.Close()
-	return json.NewDecoder(r.Body).Decode(v)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		if err != nil {
+			return decodeError(err)
+		}
+		return errors.New("request body must hold a single JSON value")
+	}
+	return nil
+}
+
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, io.EOF):
+		return errors.New("request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("request body is not valid JSON: unexpected end")
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("request body is not valid JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("request body must be %s", describe(typeErr.Type))
+		}
+		return fmt.Errorf("field %q must be %s", typeErr.Field, describe(typeErr.Type))
+	case errors.As(err, &maxErr):
+		return err
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return fmt.Errorf("invalid request body: %w", err)
+}
+
+// describe names the JSON type that decodes into t.
+func describe(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return describe(t.Elem())
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// InvalidBody responds to a request whose body Decode rejected: 413 if the
+// body was over its size limit, otherwise 400 with the reason.
+func InvalidBody(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		Error(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large (limit %d bytes)", maxErr.Limit))
+		return
+	}
+	Error(w, http.StatusBadRequest, err.Error())
 }
@@ -61,3 +61,55 @@ func TestDecode(t *testing.T) {
 		t.Fatalf("age = %d, want 30", v.Age)
 	}
 }
+
+func TestDecodeErrors(t *testing.T) {
+	type request struct {
+		Name string   `json:"name"`
+		Age  int      `json:"age"`
+		Tags []string `json:"tags"`
+	}
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{``, "request body is empty"},
+		{`{"name":"alice"`, "request body is not valid JSON: unexpected end"},
+		{`{"name":alice}`, "request body is not valid JSON at offset 9"},
+		{`{"name":"alice","admin":true}`, `unknown field "admin"`},
+		{`{"age":"thirty"}`, `field "age" must be an integer`},
+		{`{"tags":"a,b"}`, `field "tags" must be an array`},
+		{`["alice"]`, "request body must be an object"},
+		{`{"name":"alice"} {"name":"bob"}`, "request body must hold a single JSON value"},
+		{`{"name":"alice"} x`, "request body is not valid JSON at offset 18"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		var v request
+		err := Decode(r, &v)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Decode(%s) = %v, want %q", tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestInvalidBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"`+strings.Repeat("a", 100)+`"}`))
+	w := httptest.NewRecorder()
+	r.Body = http.MaxBytesReader(w, r.Body, 32)
+	var v struct {
+		Name string `json:"name"`
+	}
+	InvalidBody(w, Decode(r, &v))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if !strings.Contains(w.Body.String(), "request body too large (limit 32 bytes)") {
+		t.Fatalf("body = %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"nmae":"alice"}`))
+	InvalidBody(w, Decode(r, &v))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `unknown field \"nmae\"`) {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,520 @@
+// Package jobs is a Postgres-backed background job queue.
+//
+// Jobs are rows in the jobs table. Workers claim due jobs with
+// FOR UPDATE SKIP LOCKED, so any number of server instances can share the
+// queue. Failed jobs are retried with exponential backoff until they run out
+// of attempts, then kept as dead letters. EnqueueTx writes a job inside the
+// caller's transaction, so the job exists if and only if the change commits.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"trello-clone/internal/health"
+)
+
+// Job statuses.
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDead    = "dead"
+)
+
+type Job struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error"`
+	// RedactedAt is when the payload of a dead job was erased; see Redact.
+	RedactedAt *time.Time `json:"redacted_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type handlerFunc func(ctx context.Context, payload json.RawMessage) error
+
+type schedule struct {
+	name     string
+	spec     string
+	schedule Schedule
+	kind     string
+	payload  json.RawMessage
+}
+
+// Queue enqueues jobs and runs the registered handlers. Register handlers
+// and schedules before calling Start.
+type Queue struct {
+	DB *sql.DB
+	// Workers is the number of jobs run concurrently by this instance.
+	Workers int
+	// PollInterval is how long an idle worker waits before looking for due
+	// jobs again.
+	PollInterval time.Duration
+	// Lease is how long a claimed job is hidden from other workers. It is
+	// also the handler's timeout; a job whose worker dies becomes due again
+	// once its lease ends.
+	Lease time.Duration
+	// MaxAttempts is the default number of attempts before a job is
+	// dead-lettered.
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry; it doubles with each
+	// attempt up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	handlers  map[string]handlerFunc
+	redacted  map[string]bool
+	schedules []schedule
+
+	stop       chan struct{}
+	stopOnce   sync.Once
+	cancelJobs context.CancelFunc
+	wg         sync.WaitGroup
+	tracker    health.Tracker
+}
+
+func New(db *sql.DB) *Queue {
+	return &Queue{
+		DB:           db,
+		Workers:      4,
+		PollInterval: time.Second,
+		Lease:        5 * time.Minute,
+		MaxAttempts:  10,
+		BaseBackoff:  10 * time.Second,
+		MaxBackoff:   time.Hour,
+		handlers:     map[string]handlerFunc{},
+		redacted:     map[string]bool{},
+	}
+}
+
+// Register sets the handler for jobs of kind. The JSON payload is decoded
+// into T before fn is called.
+func Register[T any](q *Queue, kind string, fn func(ctx context.Context, args T) error) {
+	q.handlers[kind] = func(ctx context.Context, payload json.RawMessage) error {
+		var args T
+		if err := json.Unmarshal(payload, &args); err != nil {
+			return Permanent(fmt.Errorf("decode payload: %w", err))
+		}
+		return fn(ctx, args)
+	}
+}
+
+// Redact marks the payloads of kind as secret. Succeeded jobs are deleted
+// anyway; a dead-lettered job of kind has its payload erased rather than
+// kept for inspection, so it can't be retried.
+func (q *Queue) Redact(kind string) {
+	q.redacted[kind] = true
+}
+
+// Schedule enqueues a job of kind with args whenever spec (see
+// ParseSchedule) comes due. name identifies the schedule across instances
+// and restarts; only one instance enqueues each run.
+func (q *Queue) Schedule(name, spec, kind string, args any) error {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	q.schedules = append(q.schedules, schedule{name: name, spec: spec, schedule: s, kind: kind, payload: payload})
+	return nil
+}
+
+// permanentError marks a failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the job is dead-lettered without further retries.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Enqueueing
+
+type options struct {
+	runAt       time.Time
+	maxAttempts int
+}
+
+type Option func(*options)
+
+// RunAt delays the job until t.
+func RunAt(t time.Time) Option {
+	return func(o *options) { o.runAt = t }
+}
+
+// MaxAttempts overrides the queue's default number of attempts.
+func MaxAttempts(n int) Option {
+	return func(o *options) { o.maxAttempts = n }
+}
+
+// Enqueue adds a job of kind with args encoded as its JSON payload.
+func (q *Queue) Enqueue(ctx context.Context, kind string, args any, opts ...Option) (string, error) {
+	return q.insert(ctx, q.DB, kind, args, opts)
+}
+
+// EnqueueTx adds a job inside tx, so it only becomes visible to workers if
+// tx commits.
+func (q *Queue) EnqueueTx(ctx context.Context, tx *sql.Tx, kind string, args any, opts ...Option) (string, error) {
+	return q.insert(ctx, tx, kind, args, opts)
+}
+
+type execer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (q *Queue) insert(ctx context.Context, db execer, kind string, args any, opts []Option) (string, error) {
+	o := options{maxAttempts: q.MaxAttempts}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	var runAt *time.Time
+	if !o.runAt.IsZero() {
+		runAt = &o.runAt
+	}
+
+	var id string
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO jobs (kind, payload, max_attempts, run_at) VALUES ($1, $2, $3, COALESCE($4, now()))
+		 RETURNING id`,
+		kind, string(payload), o.maxAttempts, runAt,
+	).Scan(&id)
+	return id, err
+}
+
+// Dead letters
+
+// ListDead returns the most recent dead-lettered jobs.
+func (q *Queue) ListDead(ctx context.Context, limit int) ([]Job, error) {
+	rows, err := q.DB.QueryContext(ctx,
+		`SELECT id, kind, payload, status, attempts, max_attempts, run_at, last_error, redacted_at, created_at
+		 FROM jobs WHERE status='dead' ORDER BY run_at DESC LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// Retry makes a dead job due immediately with a fresh retry budget. Jobs
+// whose payload was redacted can't be retried.
+func (q *Queue) Retry(ctx context.Context, id string) error {
+	res, err := q.DB.ExecContext(ctx,
+		`UPDATE jobs SET status='pending', attempts=0, run_at=now()
+		 WHERE id=$1 AND status='dead' AND redacted_at IS NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Running
+
+// Start launches the workers and the scheduler. Stop them with Shutdown.
+func (q *Queue) Start(ctx context.Context) error {
+	if err := q.registerSchedules(ctx); err != nil {
+		return err
+	}
+
+	q.stop = make(chan struct{})
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	q.cancelJobs = cancel
+
+	for range q.Workers {
+		q.wg.Add(1)
+		go q.work(jobCtx)
+	}
+	if len(q.schedules) > 0 {
+		q.wg.Add(1)
+		go q.runScheduler(jobCtx)
+	}
+	q.tracker.Start(q.Workers)
+	return nil
+}
+
+// Status reports whether the workers are running, when they last looked
+// for jobs and the last error they ran into.
+func (q *Queue) Status() health.WorkerStatus {
+	return q.tracker.Status()
+}
+
+// Shutdown stops claiming new jobs and waits for running ones to finish.
+// If ctx ends first, running jobs are cancelled; they are retried later.
+// It does nothing if the queue was never started, and may be called again.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	if q.stop == nil {
+		return nil
+	}
+	q.stopOnce.Do(func() {
+		q.tracker.Stop()
+		close(q.stop)
+	})
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancelJobs()
+		return nil
+	case <-ctx.Done():
+		q.cancelJobs()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		ran, err := q.RunNext(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "jobs: run", "error", err)
+		} else {
+			err = nil
+		}
+		q.tracker.Poll(err)
+		if ran {
+			continue
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// RunNext claims and runs one due job. It reports whether there was one.
+func (q *Queue) RunNext(ctx context.Context) (bool, error) {
+	job, err := q.claim(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	runErr := q.run(ctx, job)
+	// Record the outcome even if the job was cancelled by Shutdown.
+	return true, q.finish(context.WithoutCancel(ctx), job, runErr)
+}
+
+// claim leases the oldest due job, including running jobs whose lease has
+// run out because their worker died.
+func (q *Queue) claim(ctx context.Context) (*Job, error) {
+	row := q.DB.QueryRowContext(ctx,
+		`UPDATE jobs SET status='running', attempts = attempts + 1,
+			locked_until = now() + $1::bigint * interval '1 millisecond'
+		 WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status='pending' AND run_at <= now())
+			   OR (status='running' AND locked_until < now())
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, kind, payload, status, attempts, max_attempts, run_at, last_error, redacted_at, created_at`,
+		q.Lease.Milliseconds(),
+	)
+	return scanJob(row)
+}
+
+func (q *Queue) run(ctx context.Context, job *Job) (err error) {
+	h, ok := q.handlers[job.Kind]
+	if !ok {
+		return Permanent(fmt.Errorf("no handler registered for %q", job.Kind))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.Lease)
+	defer cancel()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return h(ctx, job.Payload)
+}
+
+// finish deletes a succeeded job, or schedules a retry, or dead-letters it.
+// It only touches the job while this worker still holds its lease: if the
+// lease ran out and another worker claimed the job, that run's outcome is
+// the one recorded.
+func (q *Queue) finish(ctx context.Context, job *Job, runErr error) error {
+	if runErr == nil {
+		res, err := q.DB.ExecContext(ctx,
+			`DELETE FROM jobs WHERE id=$1 AND status='running' AND attempts=$2`,
+			job.ID, job.Attempts,
+		)
+		return q.checkLease(ctx, job, res, err)
+	}
+
+	var perm permanentError
+	status, runAt := StatusPending, time.Now().Add(q.backoff(job.Attempts))
+	redact := false
+	if errors.As(runErr, &perm) || job.Attempts >= job.MaxAttempts {
+		status, runAt = StatusDead, time.Now()
+		redact = q.redacted[job.Kind]
+		slog.ErrorContext(ctx, "jobs: job dead", "kind", job.Kind, "job_id", job.ID, "attempts", job.Attempts, "error", runErr)
+	}
+	res, err := q.DB.ExecContext(ctx,
+		`UPDATE jobs SET status=$2, run_at=$3, locked_until=NULL, last_error=$4,
+			payload = CASE WHEN $5 THEN 'null'::jsonb ELSE payload END,
+			redacted_at = CASE WHEN $5 THEN now() END
+		 WHERE id=$1 AND status='running' AND attempts=$6`,
+		job.ID, status, runAt, runErr.Error(), redact, job.Attempts,
+	)
+	return q.checkLease(ctx, job, res, err)
+}
+
+// checkLease logs a finish that matched no row: the job's lease ran out
+// while it ran and another worker has claimed it since.
+func (q *Queue) checkLease(ctx context.Context, job *Job, res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		slog.WarnContext(ctx, "jobs: lease lost, outcome dropped", "kind", job.Kind, "job_id", job.ID, "attempts", job.Attempts)
+	}
+	return nil
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.BaseBackoff
+	for i := 1; i < attempts && delay < q.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, q.MaxBackoff)
+}
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	j := &Job{}
+	var payload []byte
+	err := row.Scan(&j.ID, &j.Kind, &payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAt, &j.LastError, &j.RedactedAt, &j.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	j.Payload = payload
+	return j, nil
+}
+
+// Scheduling
+
+// registerSchedules stores each schedule's first run. A schedule whose spec
+// changed since it was stored gets its next run recomputed.
+func (q *Queue) registerSchedules(ctx context.Context) error {
+	for _, s := range q.schedules {
+		_, err := q.DB.ExecContext(ctx,
+			`INSERT INTO job_schedules (name, spec, next_run_at) VALUES ($1, $2, $3)
+			 ON CONFLICT (name) DO UPDATE SET spec = EXCLUDED.spec, next_run_at = EXCLUDED.next_run_at
+			 WHERE job_schedules.spec <> EXCLUDED.spec`,
+			s.name, s.spec, s.schedule.Next(time.Now()),
+		)
+		if err != nil {
+			return fmt.Errorf("register schedule %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+func (q *Queue) runScheduler(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		_, err := q.EnqueueScheduled(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "jobs: scheduler", "error", err)
+		} else {
+			err = nil
+		}
+		q.tracker.Poll(err)
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// EnqueueScheduled enqueues a job for every schedule that is due and
+// returns how many were enqueued.
+func (q *Queue) EnqueueScheduled(ctx context.Context) (int, error) {
+	n := 0
+	for _, s := range q.schedules {
+		ok, err := q.enqueueIfDue(ctx, s)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", s.name, err)
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// enqueueIfDue advances the schedule and enqueues its job in one
+// transaction, so exactly one instance enqueues each run.
+func (q *Queue) enqueueIfDue(ctx context.Context, s schedule) (bool, error) {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE job_schedules SET next_run_at=$2 WHERE name=$1 AND next_run_at <= now()`,
+		s.name, s.schedule.Next(time.Now()),
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if _, err := q.EnqueueTx(ctx, tx, s.kind, s.payload); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
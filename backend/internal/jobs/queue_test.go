@@ -0,0 +1,290 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"trello-clone/internal/testutil"
+)
+
+type greeting struct {
+	Name string `json:"name"`
+}
+
+func TestRunNext(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+
+	var got []string
+	Register(q, "greet", func(ctx context.Context, args greeting) error {
+		got = append(got, args.Name)
+		return nil
+	})
+
+	if _, err := q.Enqueue(ctx, "greet", greeting{Name: "Ada"}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if _, err := q.Enqueue(ctx, "greet", greeting{Name: "Later"}, RunAt(time.Now().Add(time.Hour))); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	ran, err := q.RunNext(ctx)
+	if err != nil || !ran {
+		t.Fatalf("RunNext = %v, %v; want true, nil", ran, err)
+	}
+	if len(got) != 1 || got[0] != "Ada" {
+		t.Fatalf("handled %v, want [Ada]", got)
+	}
+
+	// The remaining job is not due yet.
+	if ran, _ := q.RunNext(ctx); ran {
+		t.Fatal("ran a job that is not due")
+	}
+
+	var remaining int
+	db.QueryRow(`SELECT count(*) FROM jobs`).Scan(&remaining)
+	if remaining != 1 {
+		t.Fatalf("jobs left = %d, want 1 (succeeded jobs are deleted)", remaining)
+	}
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+	q.BaseBackoff = 0
+
+	calls := 0
+	Register(q, "flaky", func(ctx context.Context, _ struct{}) error {
+		calls++
+		return errors.New("boom")
+	})
+
+	id, err := q.Enqueue(ctx, "flaky", nil, MaxAttempts(2))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	for range 3 {
+		if _, err := q.RunNext(ctx); err != nil {
+			t.Fatalf("RunNext: %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("calls = %d, want 2", calls)
+	}
+
+	dead, err := q.ListDead(ctx, 10)
+	if err != nil {
+		t.Fatalf("list dead: %v", err)
+	}
+	if len(dead) != 1 || dead[0].ID != id || dead[0].LastError != "boom" || dead[0].Attempts != 2 {
+		t.Fatalf("dead = %+v", dead)
+	}
+
+	// Jobs without arguments have a null payload, which is not a redaction.
+	if err := q.Retry(ctx, id); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if ran, _ := q.RunNext(ctx); !ran || calls != 3 {
+		t.Fatalf("retried job did not run (calls = %d)", calls)
+	}
+}
+
+func TestRedactedDeadLetter(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+
+	Register(q, "secret", func(ctx context.Context, args struct{ Link string }) error {
+		return Permanent(errors.New("rejected"))
+	})
+	q.Redact("secret")
+	id, _ := q.Enqueue(ctx, "secret", struct{ Link string }{"https://app.test/reset?token=s3cret"})
+
+	if _, err := q.RunNext(ctx); err != nil {
+		t.Fatalf("RunNext: %v", err)
+	}
+	dead, _ := q.ListDead(ctx, 10)
+	if len(dead) != 1 || string(dead[0].Payload) != "null" || dead[0].RedactedAt == nil || dead[0].LastError != "rejected" {
+		t.Fatalf("dead = %+v, want one with its payload erased", dead)
+	}
+	if err := q.Retry(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("retry = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestFinishAfterLostLease(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+
+	id, _ := q.Enqueue(ctx, "slow", nil)
+	job, err := q.claim(ctx)
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	// The lease runs out and another worker claims the job.
+	db.Exec(`UPDATE jobs SET locked_until = now() - interval '1 second' WHERE id=$1`, id)
+	if _, err := q.claim(ctx); err != nil {
+		t.Fatalf("reclaim: %v", err)
+	}
+
+	// The first worker's late outcome must not touch the new run.
+	if err := q.finish(ctx, job, nil); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if err := q.finish(ctx, job, Permanent(errors.New("late"))); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	var status string
+	var attempts int
+	db.QueryRow(`SELECT status, attempts FROM jobs WHERE id=$1`, id).Scan(&status, &attempts)
+	if status != StatusRunning || attempts != 2 {
+		t.Fatalf("job = %s after %d attempts, want still running its second", status, attempts)
+	}
+}
+
+func TestPermanentAndUnknownKind(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+
+	Register(q, "invalid", func(ctx context.Context, _ struct{}) error {
+		return Permanent(errors.New("bad input"))
+	})
+	q.Enqueue(ctx, "invalid", nil)
+	q.Enqueue(ctx, "unknown", nil)
+
+	for range 2 {
+		if _, err := q.RunNext(ctx); err != nil {
+			t.Fatalf("RunNext: %v", err)
+		}
+	}
+
+	dead, _ := q.ListDead(ctx, 10)
+	if len(dead) != 2 {
+		t.Fatalf("dead = %d, want 2", len(dead))
+	}
+	for _, j := range dead {
+		if j.Attempts != 1 {
+			t.Errorf("%s attempts = %d, want 1", j.Kind, j.Attempts)
+		}
+	}
+}
+
+func TestEnqueueTxRollback(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+
+	tx, _ := db.BeginTx(ctx, nil)
+	if _, err := q.EnqueueTx(ctx, tx, "greet", greeting{Name: "Ghost"}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	tx.Rollback()
+
+	if ran, _ := q.RunNext(ctx); ran {
+		t.Fatal("job from rolled back transaction ran")
+	}
+}
+
+func TestEnqueueScheduled(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+
+	// Two instances share the schedule; only one enqueues each run.
+	a, b := New(db), New(db)
+	for _, q := range []*Queue{a, b} {
+		if err := q.Schedule("tick", "@hourly", "tick", nil); err != nil {
+			t.Fatalf("schedule: %v", err)
+		}
+		if err := q.registerSchedules(ctx); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+	}
+
+	if n, _ := a.EnqueueScheduled(ctx); n != 0 {
+		t.Fatalf("enqueued %d before the schedule was due", n)
+	}
+
+	db.Exec(`UPDATE job_schedules SET next_run_at = now() - interval '1 second'`)
+	na, err := a.EnqueueScheduled(ctx)
+	if err != nil {
+		t.Fatalf("enqueue scheduled: %v", err)
+	}
+	nb, _ := b.EnqueueScheduled(ctx)
+	if na+nb != 1 {
+		t.Fatalf("enqueued %d runs, want 1", na+nb)
+	}
+
+	var next time.Time
+	db.QueryRow(`SELECT next_run_at FROM job_schedules WHERE name='tick'`).Scan(&next)
+	if !next.After(time.Now()) {
+		t.Fatalf("next_run_at = %s, want in the future", next)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	db := testutil.SetupDB(t)
+	ctx := context.Background()
+	q := New(db)
+	q.PollInterval = 10 * time.Millisecond
+
+	started, finished := make(chan struct{}), make(chan struct{})
+	Register(q, "slow", func(ctx context.Context, _ struct{}) error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		close(finished)
+		return nil
+	})
+	q.Enqueue(ctx, "slow", nil)
+
+	if err := q.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	<-started
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := q.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Shutdown returned before the running job finished")
+	}
+
+	var remaining int
+	db.QueryRow(`SELECT count(*) FROM jobs`).Scan(&remaining)
+	if remaining != 0 {
+		t.Fatalf("jobs left = %d, want 0", remaining)
+	}
+}
+
+func TestShutdownWithoutStart(t *testing.T) {
+	ctx := context.Background()
+	q := New(nil)
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown before start: %v", err)
+	}
+
+	// With no workers or schedules, Start doesn't touch the database.
+	q.Workers = 0
+	if err := q.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	for range 2 {
+		if err := q.Shutdown(ctx); err != nil {
+			t.Fatalf("shutdown: %v", err)
+		}
+	}
+	if q.Status().Running {
+		t.Fatal("queue still reported running")
+	}
+}
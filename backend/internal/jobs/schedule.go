@@ -0,0 +1,183 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule decides when a recurring job runs next.
+type Schedule interface {
+	// Next returns the first run time strictly after t.
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule parses a standard five-field cron expression
+// (minute hour day-of-month month day-of-week, evaluated in UTC), one of the
+// shorthands @hourly, @daily, @weekly and @monthly, or "@every <duration>".
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("schedule %q: interval must be at least 1s", spec)
+		}
+		return every(d), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want 5 fields, got %d", spec, len(fields))
+	}
+	var c cron
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %w", spec, err)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %w", spec, err)
+	}
+	if c.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of month: %w", spec, err)
+	}
+	if c.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %w", spec, err)
+	}
+	if c.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of week: %w", spec, err)
+	}
+	// Both 0 and 7 mean Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q: never matches", spec)
+	}
+	return c, nil
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cron holds one bit per allowed value of each field.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func (c cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	// Every valid expression matches within a few years; give up after that
+	// (e.g. "0 0 31 2 *").
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows cron semantics: when both day fields are restricted, a
+// day matching either one is enough.
+func (c cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// parseField parses a comma-separated list of "*", "n", "a-b", each
+// optionally followed by "/step".
+func parseField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for part := range strings.SplitSeq(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		start, end := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = parseValue(a, lo, hi); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = parseValue(b, lo, hi); err != nil {
+					return 0, err
+				}
+				if end < start {
+					return 0, fmt.Errorf("invalid range %q", rng)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, lo, hi int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("value %d out of range %d-%d", n, lo, hi)
+	}
+	return n, nil
+}
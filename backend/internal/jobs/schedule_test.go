@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC) // a Wednesday
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"0 3 * * 1,5", time.Date(2024, 2, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}, // day of month OR Sunday
+		{"@every 90s", base.Add(90 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := ParseSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseSchedule: %v", err)
+			}
+			if got := s.Next(base); !got.Equal(tt.want) {
+				t.Fatalf("Next = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "@every 1ms", "@every soon", "0 0 31 2 *", "0 0 30 2 *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := &Queue{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := q.backoff(i + 1); got != w {
+			t.Fatalf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
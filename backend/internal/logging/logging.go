@@ -0,0 +1,103 @@
+// Package logging sets up the structured logger and carries per-request
+// fields (request ID, user ID) in the context so every log line written
+// with a request's context includes them, along with its trace ID.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a logger that writes to w. format is "json" or "text"; level
+// is "debug", "info", "warn" or "error". Empty values mean JSON at info.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("log level %q: use debug, info, warn or error", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("log format %q: use json or text", format)
+	}
+	return slog.New(&contextHandler{h}), nil
+}
+
+// request holds the fields of one request. The user ID is filled in by the
+// auth middleware once it knows who is calling, after the request's
+// context was created.
+type request struct {
+	id     string
+	userID string
+}
+
+type requestKey struct{}
+
+// WithRequestID returns a context for a new request with the given ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestKey{}, &request{id: id})
+}
+
+// RequestID returns the ID of the request ctx belongs to, or "".
+func RequestID(ctx context.Context) string {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		return req.id
+	}
+	return ""
+}
+
+// SetUserID records who made the request ctx belongs to. It does nothing
+// outside a request.
+func SetUserID(ctx context.Context, userID string) {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		req.userID = userID
+	}
+}
+
+// UserID returns the user recorded by SetUserID, or "".
+func UserID(ctx context.Context) string {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		return req.userID
+	}
+	return ""
+}
+
+// contextHandler adds the request's fields and the current trace ID to
+// records logged with its context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		r.AddAttrs(slog.String("request_id", req.id))
+		if req.userID != "" {
+			r.AddAttrs(slog.String("user_id", req.userID))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
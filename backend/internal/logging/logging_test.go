@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", ""); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+	if _, err := New(&bytes.Buffer{}, "json", "loud"); err == nil {
+		t.Fatal("expected error for unknown level")
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "text", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Fatalf("output = %q", buf.String())
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	logger.InfoContext(ctx, "before auth")
+	SetUserID(ctx, "user-1")
+	logger.With("component", "test").InfoContext(ctx, "after auth")
+	logger.InfoContext(context.Background(), "no request")
+	SetUserID(context.Background(), "ignored")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("lines = %q", lines)
+	}
+	var entries []map[string]any
+	for _, line := range lines {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("not JSON: %q", line)
+		}
+		entries = append(entries, e)
+	}
+	if entries[0]["request_id"] != "req-1" || entries[0]["user_id"] != nil {
+		t.Errorf("before auth: %v", entries[0])
+	}
+	if entries[1]["request_id"] != "req-1" || entries[1]["user_id"] != "user-1" || entries[1]["component"] != "test" {
+		t.Errorf("after auth: %v", entries[1])
+	}
+	if _, ok := entries[2]["request_id"]; ok {
+		t.Errorf("no request: %v", entries[2])
+	}
+	if RequestID(ctx) != "req-1" || UserID(ctx) != "user-1" {
+		t.Errorf("RequestID = %q, UserID = %q", RequestID(ctx), UserID(ctx))
+	}
+}
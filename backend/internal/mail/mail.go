@@ -0,0 +1,125 @@
+// Package mail sends transactional email.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+	"trello-clone/internal/jobs"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// SMTP sends mail through an SMTP server, using STARTTLS when the server
+// offers it. Username and Password are optional.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if strings.ContainsAny(m.To, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", m.To)
+	}
+
+	// From may carry a display name, which belongs in the header only.
+	sender, err := netmail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %w", s.From, err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, sender.Address, []string{m.To}, s.format(m))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SMTP) format(m Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Memory keeps sent messages in memory. It is used in tests and when no
+// SMTP server is configured.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// JobSend is the job kind that sends a Message.
+const JobSend = "mail.send"
+
+// Queued hands messages to the job queue, so requests don't wait on the
+// mail server and failed sends are retried. Register the sending side with
+// RegisterJobs.
+//
+// Messages carry sign-in links, so they only stay in the jobs table until
+// they are sent or given up on; see jobs.Queue.Redact.
+type Queued struct {
+	Jobs *jobs.Queue
+}
+
+func (q *Queued) Send(ctx context.Context, m Message) error {
+	_, err := q.Jobs.Enqueue(ctx, JobSend, m)
+	return err
+}
+
+// RegisterJobs makes q deliver queued messages through m.
+func RegisterJobs(q *jobs.Queue, m Mailer) {
+	jobs.Register(q, JobSend, m.Send)
+	q.Redact(JobSend)
+}
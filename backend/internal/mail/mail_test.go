@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSMTPFormat(t *testing.T) {
+	s := &SMTP{From: "FlowBoard <noreply@example.com>"}
+	got := string(s.format(Message{To: "ada@example.com", Subject: "Réinitialiser", Body: "line one\nline two"}))
+
+	for _, want := range []string{
+		"From: FlowBoard <noreply@example.com>\r\n",
+		"To: ada@example.com\r\n",
+		"Subject: =?utf-8?q?R=C3=A9initialiser?=\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"\r\n\r\nline one\r\nline two",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message missing %q:\n%s", want, got)
+		}
+	}
+}
+
+// fakeSMTP accepts one message and returns the MAIL FROM line it got.
+func fakeSMTP(t *testing.T) (addr string, mailFrom <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	from := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		reply := func(line string) {
+			rw.WriteString(line + "\r\n")
+			rw.Flush()
+		}
+		reply("220 fake ESMTP")
+		inData := false
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case inData:
+				if line == "." {
+					inData = false
+					reply("250 queued")
+				}
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+				reply("250 fake")
+			case strings.HasPrefix(line, "MAIL FROM:"):
+				from <- line
+				reply("250 ok")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				reply("250 ok")
+			case line == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown")
+			}
+		}
+	}()
+	return ln.Addr().String(), from
+}
+
+func TestSMTPEnvelopeSender(t *testing.T) {
+	addr, mailFrom := fakeSMTP(t)
+	s := &SMTP{Addr: addr, From: "FlowBoard <noreply@localhost>"}
+	if err := s.Send(context.Background(), Message{To: "ada@example.com", Subject: "Hi", Body: "hello"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := <-mailFrom; got != "MAIL FROM:<noreply@localhost>" && !strings.HasPrefix(got, "MAIL FROM:<noreply@localhost> ") {
+		t.Fatalf("envelope sender = %q", got)
+	}
+
+	bad := &SMTP{Addr: addr, From: "not an address"}
+	if err := bad.Send(context.Background(), Message{To: "ada@example.com"}); err == nil {
+		t.Fatal("expected an error for an invalid sender")
+	}
+}
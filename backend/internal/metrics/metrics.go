@@ -0,0 +1,143 @@
+// Package metrics collects Prometheus metrics: HTTP traffic per route, the
+// database pool, sessions and board activity. They are served by Handler,
+// meant for a listener of its own so they aren't exposed with the API.
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "flowboard"
+
+// Metrics holds the registry and the metrics the server updates.
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	activity *prometheus.CounterVec
+}
+
+// New registers the metrics. With db set it also reports the connection
+// pool and active sessions, read from the database on every scrape.
+func New(db *sql.DB) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route pattern and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		activity: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "card_activity_total",
+			Help:      "Card activity recorded, by kind (card.created, card.moved, ...).",
+		}, []string{"kind"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.duration, m.activity,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if db != nil {
+		m.registry.MustRegister(
+			collectors.NewDBStatsCollector(db, "flowboard"),
+			&sessionCollector{db: db},
+		)
+	}
+	return m
+}
+
+// ObserveRequest records a finished request. route is the ServeMux pattern
+// that matched, so IDs in paths don't create a series each.
+func (m *Metrics) ObserveRequest(route, method string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "other"
+	}
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.duration.WithLabelValues(route, method).Observe(elapsed.Seconds())
+}
+
+// CardActivity counts one card activity entry of the given kind.
+func (m *Metrics) CardActivity(kind string) {
+	m.activity.WithLabelValues(kind).Inc()
+}
+
+// InitActivity makes the activity counters for kinds start at zero.
+func (m *Metrics) InitActivity(kinds ...string) {
+	for _, kind := range kinds {
+		m.activity.WithLabelValues(kind)
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format. If token
+// is set, scrapes must send it as "Authorization: Bearer <token>".
+func (m *Metrics) Handler(token string) http.Handler {
+	return RequireToken(token, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// RequireToken makes h answer 401 unless the request sends token as
+// "Authorization: Bearer <token>". An empty token lets every request in.
+func RequireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sessionCollector reports the number of active sessions, counted when
+// scraped.
+type sessionCollector struct {
+	db *sql.DB
+}
+
+var sessionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "sessions_active"),
+	"Sessions that have not expired.",
+	nil, nil,
+)
+
+func (c *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+}
+
+func (c *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var n int
+	if err := c.db.QueryRowContext(ctx,
+		`SELECT count(*) FROM sessions WHERE expires_at > now()`,
+	).Scan(&n); err != nil {
+		ch <- prometheus.NewInvalidMetric(sessionsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(n))
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, h http.Handler, token string) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	body, _ := io.ReadAll(w.Body)
+	return w.Code, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := New(nil)
+	m.InitActivity("card.created", "card.moved")
+	m.ObserveRequest("GET /api/boards/{id}", http.MethodGet, http.StatusOK, 20*time.Millisecond)
+	m.ObserveRequest("", "BREW", http.StatusNotFound, time.Millisecond)
+	m.CardActivity("card.moved")
+
+	code, body := scrape(t, m.Handler(""), "")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	for _, want := range []string{
+		`flowboard_http_requests_total{code="200",method="GET",route="GET /api/boards/{id}"} 1`,
+		`flowboard_http_requests_total{code="404",method="other",route="unmatched"} 1`,
+		`flowboard_http_request_duration_seconds_bucket{method="GET",route="GET /api/boards/{id}",le="0.025"} 1`,
+		`flowboard_card_activity_total{kind="card.created"} 0`,
+		`flowboard_card_activity_total{kind="card.moved"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestHandlerToken(t *testing.T) {
+	h := New(nil).Handler("s3cret")
+	if code, _ := scrape(t, h, ""); code != http.StatusUnauthorized {
+		t.Fatalf("no token: status = %d", code)
+	}
+	if code, _ := scrape(t, h, "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: status = %d", code)
+	}
+	if code, _ := scrape(t, h, "s3cret"); code != http.StatusOK {
+		t.Fatalf("token: status = %d", code)
+	}
+}
@@ -1,25 +1,248 @@
 package server
 
 import (
-	"log"
+	"crypto/rand"
+	"log/slog"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"runtime/debug"
+	"strings"
 	"time"
+	"trello-clone/internal/httputil"
+	"trello-clone/internal/logging"
+	"trello-clone/internal/metrics"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func logging(next http.Handler) http.Handler {
+// requestIDHeader carries the request ID. One sent by a proxy in front of
+// the server is kept, so its logs and ours can be matched up.
+const requestIDHeader = "X-Request-ID"
+
+// requestID gives every request an ID, taken from X-Request-ID when the
+// client sent a sensible one, and echoes it in the response.
+func requestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = rand.Text()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
 	})
 }
 
+// validRequestID accepts IDs of up to 128 letters, digits and "-_.:".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("-_.:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// realIP sets r.RemoteAddr to the client's address when the request came
+// through one of the trusted proxies, so logging, login lockouts and
+// sessions all see the client rather than the proxy. X-Forwarded-For is
+// read from the right, skipping trusted hops; the first untrusted address
+// is the client. Headers from anyone else are ignored, since clients can
+// send whatever they like.
+func realIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	isTrusted := func(ip netip.Addr) bool {
+		for _, p := range trusted {
+			if p.Contains(ip.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil || !isTrusted(peer.Addr()) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			client := peer.Addr()
+			hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+				if err != nil {
+					break
+				}
+				client = ip.Unmap()
+				if !isTrusted(client) {
+					break
+				}
+			}
+			r.RemoteAddr = client.String()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder remembers the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// code is the status sent, 200 if the handler never set one.
+func (rec *statusRecorder) code() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// accessLog writes one line per request. The request ID and, once the
+// request is authenticated, the user ID are added by the logger's handler.
+func accessLog(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.code()),
+				slog.Int("bytes", rec.bytes),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+		})
+	}
+}
+
+// instrument records every request in m, labelled with the mux pattern
+// that handles it.
+func instrument(m *metrics.Metrics, mux *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, route := mux.Handler(r)
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			m.ObserveRequest(route, r.Method, rec.code(), time.Since(start))
+		})
+	}
+}
+
+// traceRequests starts a server span for every request, continuing the
+// trace from a W3C traceparent header and named after the mux pattern.
+func traceRequests(tp trace.TracerProvider, mux *http.ServeMux) func(http.Handler) http.Handler {
+	tracer := tp.Tracer("trello-clone/internal/server")
+	propagator := propagation.TraceContext{}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, route := mux.Handler(r)
+			name := route
+			if name == "" {
+				name = r.Method
+			}
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(r.URL.Path),
+				),
+			)
+			defer span.End()
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+			span.SetAttributes(semconv.HTTPResponseStatusCode(rec.code()))
+			if rec.code() >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(rec.code()))
+			}
+		})
+	}
+}
+
+// securityHeaders tells browsers to treat responses as data only: the API
+// serves no pages, so nothing may be loaded, framed or sniffed from it, and
+// URLs (which may hold feed tokens) are not leaked as referrers. With hsts
+// set, or on a TLS connection, browsers are also told to use HTTPS only.
+func securityHeaders(hsts bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'")
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+			if hsts || r.TLS != nil {
+				h.Set("Strict-Transport-Security", "max-age=31536000")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitBody caps request bodies at limit bytes, or at the limit routeLimits
+// gives the mux pattern handling the request. A body declared larger is
+// rejected straight away; reading past the cap fails with
+// *http.MaxBytesError, which httputil.InvalidBody answers with 413.
+func limitBody(mux *http.ServeMux, limit int64, routeLimits map[string]int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil && r.Body != http.NoBody {
+				n := limit
+				if _, route := mux.Handler(r); routeLimits[route] > 0 {
+					n = routeLimits[route]
+				}
+				if r.ContentLength > n {
+					httputil.InvalidBody(w, &http.MaxBytesError{Limit: n})
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, n)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func recovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("panic: %v\n%s", err, debug.Stack())
+				slog.ErrorContext(r.Context(), "panic", "error", err, "stack", string(debug.Stack()))
 				http.Error(w, "internal server error", http.StatusInternalServerError)
 			}
 		}()
@@ -31,8 +254,8 @@ func cors(allowOrigin string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 			if r.Method == http.MethodOptions {
@@ -43,3 +266,61 @@ func cors(allowOrigin string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// csrf rejects state-changing requests that a browser sends on behalf of
+// another site. Browsers label requests with Sec-Fetch-Site and Origin,
+// which pages can't set: a request passes if it is same-origin or comes
+// from one of trustedOrigins (the frontend). Requests with neither header
+// don't come from a browser (the frontend's server-side fetches, curl),
+// and bearer-token requests carry no ambient credentials, so both are
+// exempt.
+func csrf(trustedOrigins ...string) func(http.Handler) http.Handler {
+	trusted := make(map[string]bool)
+	for _, o := range trustedOrigins {
+		if o != "" {
+			trusted[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !crossSite(r, trusted) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			httputil.Error(w, http.StatusForbidden, "cross-site request rejected")
+		})
+	}
+}
+
+// crossSite reports whether r is a state-changing browser request from an
+// origin that isn't trusted.
+func crossSite(r *http.Request, trusted map[string]bool) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if h := r.Header.Get("Authorization"); len(h) >= 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return false
+	}
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		// "none" is a navigation the user started, e.g. from a bookmark.
+		return false
+	case "":
+		// Older browsers only send Origin.
+	default:
+		// same-site or cross-site: only the trusted origins may send these.
+		return !trusted[strings.ToLower(r.Header.Get("Origin"))]
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	if trusted[strings.ToLower(origin)] {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
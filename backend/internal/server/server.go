@@ -1,11 +1,27 @@
 package server
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/netip"
+	"strings"
+	"time"
 	"trello-clone/internal/auth"
 	"trello-clone/internal/board"
+	"trello-clone/internal/feed"
+	"trello-clone/internal/health"
 	"trello-clone/internal/httputil"
+	"trello-clone/internal/jobs"
+	"trello-clone/internal/mail"
+	"trello-clone/internal/metrics"
+	"trello-clone/internal/webhook"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -17,24 +33,154 @@ type Config struct {
 	GoogleSecret  string
 	MicrosoftID   string
 	MicrosoftSecret string
+	// OIDCProviders are generic OpenID Connect providers, signed in with
+	// at /api/auth/oauth/{name}.
+	OIDCProviders []auth.OIDCProviderConfig
+	// OAuthRedirectAllowlist holds extra origins an OAuth login may return
+	// to via ?redirect_to=; AllowOrigin is always allowed.
+	OAuthRedirectAllowlist []string
+	// SessionLifetime and SessionIdleTimeout bound session length; zero
+	// values use the auth package defaults.
+	SessionLifetime    time.Duration
+	SessionIdleTimeout time.Duration
+	// Jobs, if set, gets the handlers and schedules for background jobs.
+	Jobs *jobs.Queue
+	// Mailer sends email. Defaults to an in-memory mailer. With Jobs set,
+	// mail is sent from a background job.
+	Mailer mail.Mailer
+	// Logger writes the access log. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Metrics, if set, records requests and card activity. It is served on
+	// a listener of its own, not by this server.
+	Metrics *metrics.Metrics
+	// TracerProvider traces requests. Defaults to the global provider.
+	TracerProvider trace.TracerProvider
+	// Health answers /livez and /readyz. Defaults to a checker of DB alone;
+	// pass one to add background workers and fail readiness on shutdown.
+	Health *health.Checker
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// names the client. Without them the connection's address is used.
+	TrustedProxies []netip.Prefix
+	// Server timeouts; zero values use the defaults below.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxBodyBytes caps request bodies on routes without a limit of their
+	// own in bodyLimits. Defaults to 1 MiB.
+	MaxBodyBytes int64
 }
 
-func New(cfg Config) *http.Server {
-	authStore := &auth.Store{DB: cfg.DB}
-	boardStore := &board.Store{DB: cfg.DB}
+// Defaults for the Config fields of the same names.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMaxBodyBytes      = 1 << 20
+)
 
-	authHandler := &auth.Handler{Store: authStore, CookieDomain: cfg.CookieDomain}
+// bodyLimits are the request body limits of routes that take files rather
+// than a small JSON object.
+var bodyLimits = map[string]int64{
+	"POST /api/boards/{id}/cards/import": 10 << 20,
+}
+
+// New builds the API server. It fails if an OIDC provider can't be set up
+// or the background jobs the handlers rely on can't be scheduled.
+func New(cfg Config) (*http.Server, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	tp := cfg.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	checker := cfg.Health
+	if checker == nil {
+		checker = &health.Checker{DB: cfg.DB}
+	}
+
+	authStore := &auth.Store{
+		DB:                 cfg.DB,
+		SessionLifetime:    cfg.SessionLifetime,
+		SessionIdleTimeout: cfg.SessionIdleTimeout,
+	}
+	webhookStore := &webhook.Store{DB: cfg.DB}
+	boardStore := &board.Store{DB: cfg.DB, OnActivity: webhookStore.Enqueue}
+	if cfg.Metrics != nil {
+		cfg.Metrics.InitActivity(board.ActivityCreated, board.ActivityUpdated, board.ActivityMoved)
+		boardStore.AfterActivity = func(a board.Activity) {
+			cfg.Metrics.CardActivity(a.Kind)
+		}
+	}
+
+	mailer := cfg.Mailer
+	if mailer == nil {
+		mailer = &mail.Memory{}
+	}
+	if cfg.Jobs != nil {
+		mail.RegisterJobs(cfg.Jobs, mailer)
+		mailer = &mail.Queued{Jobs: cfg.Jobs}
+	}
+
+	authHandler := &auth.Handler{
+		Store:        authStore,
+		CookieDomain: cfg.CookieDomain,
+		Mailer:       mailer,
+		AppURL:       cfg.AllowOrigin,
+	}
 	boardHandler := &board.Handler{Store: boardStore}
+	webhookHandler := &webhook.Handler{Store: webhookStore, Boards: boardStore}
+	feedHandler := &feed.Handler{
+		Store:  &feed.Store{DB: cfg.DB},
+		Boards: boardStore,
+		APIURL: cfg.BaseURL,
+		AppURL: cfg.AllowOrigin,
+	}
 
 	oauthCfg := auth.NewOAuthConfig(cfg.BaseURL, cfg.GoogleID, cfg.GoogleSecret, cfg.MicrosoftID, cfg.MicrosoftSecret)
+	for _, p := range cfg.OIDCProviders {
+		if err := oauthCfg.AddOIDC(p); err != nil {
+			return nil, err
+		}
+	}
 	oauthHandler := &auth.OAuthHandler{
-		Config:       oauthCfg,
-		Store:        authStore,
-		CookieDomain: cfg.CookieDomain,
-		BaseURL:      cfg.AllowOrigin,
+		Config:            oauthCfg,
+		Store:             authStore,
+		CookieDomain:      cfg.CookieDomain,
+		BaseURL:           cfg.AllowOrigin,
+		RedirectAllowlist: cfg.OAuthRedirectAllowlist,
+	}
+
+	if cfg.Jobs != nil {
+		jobs.Register(cfg.Jobs, auth.JobCleanupSessions, func(ctx context.Context, _ struct{}) error {
+			return authHandler.CleanupSessions(ctx)
+		})
+		if err := cfg.Jobs.Schedule("cleanup-sessions", "@hourly", auth.JobCleanupSessions, nil); err != nil {
+			return nil, fmt.Errorf("schedule cleanup-sessions: %w", err)
+		}
+		jobs.Register(cfg.Jobs, auth.JobDeleteAccounts, func(ctx context.Context, _ struct{}) error {
+			return authHandler.DeleteDueAccounts(ctx)
+		})
+		if err := cfg.Jobs.Schedule("delete-accounts", "@hourly", auth.JobDeleteAccounts, nil); err != nil {
+			return nil, fmt.Errorf("schedule delete-accounts: %w", err)
+		}
+		jobs.Register(cfg.Jobs, auth.JobPasswordReset, authHandler.SendPasswordReset)
+		cfg.Jobs.Redact(auth.JobPasswordReset)
+		authHandler.Jobs = cfg.Jobs
 	}
 
 	requireAuth := auth.RequireAuth(authStore)
+	// authed requires a session, or an access token granted scope.
+	authed := func(scope string, h http.HandlerFunc) http.Handler {
+		return requireAuth(auth.RequireScope(scope)(h))
+	}
+	// sessionOnly requires a session; access tokens can't manage credentials.
+	sessionOnly := func(h http.HandlerFunc) http.Handler {
+		return requireAuth(auth.RequireSession(h))
+	}
 
 	mux := http.NewServeMux()
 
@@ -42,40 +188,111 @@ func New(cfg Config) *http.Server {
 	mux.HandleFunc("GET /api/health", func(w http.ResponseWriter, r *http.Request) {
 		httputil.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	})
+	mux.HandleFunc("GET /livez", checker.Live)
+	mux.HandleFunc("GET /readyz", checker.Ready)
 
 	// Auth (public)
 	mux.HandleFunc("POST /api/auth/signup", authHandler.Signup)
 	mux.HandleFunc("POST /api/auth/login", authHandler.Login)
+	mux.HandleFunc("POST /api/auth/login/2fa", authHandler.LoginTwoFactor)
+	mux.HandleFunc("POST /api/auth/password/forgot", authHandler.RequestPasswordReset)
+	mux.HandleFunc("POST /api/auth/password/reset", authHandler.ResetPassword)
+	mux.HandleFunc("POST /api/auth/email/verify", authHandler.VerifyEmail)
+	mux.HandleFunc("POST /api/auth/email/change/confirm", authHandler.ConfirmEmailChange)
 	mux.HandleFunc("GET /api/auth/oauth/{provider}", oauthHandler.Redirect)
 	mux.HandleFunc("GET /api/auth/oauth/{provider}/callback", oauthHandler.Callback)
 
-	// Auth (requires session)
+	// Auth (requires session or token)
 	mux.Handle("POST /api/auth/logout", requireAuth(http.HandlerFunc(authHandler.Logout)))
-	mux.Handle("GET /api/auth/me", requireAuth(http.HandlerFunc(authHandler.Me)))
+	mux.Handle("GET /api/auth/me", authed(auth.ScopeAccountRead, authHandler.Me))
+	mux.Handle("DELETE /api/auth/me", sessionOnly(authHandler.DeleteAccount))
+	mux.Handle("DELETE /api/auth/me/deletion", authed(auth.ScopeAccountWrite, authHandler.CancelAccountDeletion))
+	mux.Handle("GET /api/auth/me/export", authed(auth.ScopeAccountRead, authHandler.ExportAccount))
+	mux.Handle("POST /api/auth/email/verify/resend", authed(auth.ScopeAccountWrite, authHandler.ResendEmailVerification))
+	mux.Handle("PUT /api/auth/email", sessionOnly(authHandler.ChangeEmail))
+	mux.Handle("PUT /api/auth/password", sessionOnly(authHandler.ChangePassword))
+
+	// Sessions
+	mux.Handle("GET /api/auth/sessions", authed(auth.ScopeAccountRead, authHandler.ListSessions))
+	mux.Handle("DELETE /api/auth/sessions", sessionOnly(authHandler.RevokeOtherSessions))
+	mux.Handle("DELETE /api/auth/sessions/{id}", sessionOnly(authHandler.RevokeSession))
+
+	// Linked OAuth identities
+	mux.Handle("GET /api/auth/identities", authed(auth.ScopeAccountRead, oauthHandler.ListIdentities))
+	mux.Handle("POST /api/auth/oauth/{provider}/link", sessionOnly(oauthHandler.StartLink))
+	mux.Handle("DELETE /api/auth/identities/{id}", sessionOnly(oauthHandler.UnlinkIdentity))
+
+	// Two-factor authentication
+	mux.Handle("POST /api/auth/2fa/setup", sessionOnly(authHandler.SetupTwoFactor))
+	mux.Handle("POST /api/auth/2fa/confirm", sessionOnly(authHandler.ConfirmTwoFactor))
+	mux.Handle("POST /api/auth/2fa/disable", sessionOnly(authHandler.DisableTwoFactor))
+
+	// Personal access tokens
+	mux.Handle("GET /api/auth/tokens", authed(auth.ScopeAccountRead, authHandler.ListAccessTokens))
+	mux.Handle("POST /api/auth/tokens", sessionOnly(authHandler.CreateAccessToken))
+	mux.Handle("DELETE /api/auth/tokens/{id}", sessionOnly(authHandler.DeleteAccessToken))
 
 	// Boards
-	mux.Handle("GET /api/boards", requireAuth(http.HandlerFunc(boardHandler.ListBoards)))
-	mux.Handle("POST /api/boards", requireAuth(http.HandlerFunc(boardHandler.CreateBoard)))
-	mux.Handle("GET /api/boards/{id}", requireAuth(http.HandlerFunc(boardHandler.GetBoard)))
-	mux.Handle("DELETE /api/boards/{id}", requireAuth(http.HandlerFunc(boardHandler.DeleteBoard)))
+	mux.Handle("GET /api/boards", authed(auth.ScopeBoardsRead, boardHandler.ListBoards))
+	mux.Handle("POST /api/boards", authed(auth.ScopeBoardsWrite, boardHandler.CreateBoard))
+	mux.Handle("GET /api/boards/{id}", authed(auth.ScopeBoardsRead, boardHandler.GetBoard))
+	mux.Handle("DELETE /api/boards/{id}", authed(auth.ScopeBoardsWrite, boardHandler.DeleteBoard))
+	mux.Handle("GET /api/boards/{id}/cards.csv", authed(auth.ScopeBoardsRead, boardHandler.ExportCardsCSV))
+	mux.Handle("POST /api/boards/{id}/cards/import", authed(auth.ScopeBoardsWrite, boardHandler.ImportCardsCSV))
+	mux.Handle("GET /api/boards/{id}/export.md", authed(auth.ScopeBoardsRead, boardHandler.ExportMarkdown))
 
 	// Columns
-	mux.Handle("POST /api/boards/{boardID}/columns", requireAuth(http.HandlerFunc(boardHandler.CreateColumn)))
-	mux.Handle("PATCH /api/columns/{id}", requireAuth(http.HandlerFunc(boardHandler.UpdateColumn)))
-	mux.Handle("DELETE /api/columns/{id}", requireAuth(http.HandlerFunc(boardHandler.DeleteColumn)))
+	mux.Handle("POST /api/boards/{boardID}/columns", authed(auth.ScopeBoardsWrite, boardHandler.CreateColumn))
+	mux.Handle("PATCH /api/columns/{id}", authed(auth.ScopeBoardsWrite, boardHandler.UpdateColumn))
+	mux.Handle("DELETE /api/columns/{id}", authed(auth.ScopeBoardsWrite, boardHandler.DeleteColumn))
 
 	// Cards
-	mux.Handle("POST /api/columns/{columnID}/cards", requireAuth(http.HandlerFunc(boardHandler.CreateCard)))
-	mux.Handle("PATCH /api/cards/{id}", requireAuth(http.HandlerFunc(boardHandler.UpdateCard)))
-	mux.Handle("DELETE /api/cards/{id}", requireAuth(http.HandlerFunc(boardHandler.DeleteCard)))
-	mux.Handle("POST /api/columns/{id}/move", requireAuth(http.HandlerFunc(boardHandler.MoveColumn)))
-	mux.Handle("POST /api/cards/{id}/move", requireAuth(http.HandlerFunc(boardHandler.MoveCard)))
+	mux.Handle("POST /api/columns/{columnID}/cards", authed(auth.ScopeBoardsWrite, boardHandler.CreateCard))
+	mux.Handle("PATCH /api/cards/{id}", authed(auth.ScopeBoardsWrite, boardHandler.UpdateCard))
+	mux.Handle("DELETE /api/cards/{id}", authed(auth.ScopeBoardsWrite, boardHandler.DeleteCard))
+	mux.Handle("POST /api/columns/{id}/move", authed(auth.ScopeBoardsWrite, boardHandler.MoveColumn))
+	mux.Handle("POST /api/cards/{id}/move", authed(auth.ScopeBoardsWrite, boardHandler.MoveCard))
+
+	// Webhooks
+	mux.Handle("GET /api/boards/{id}/webhooks", authed(auth.ScopeBoardsRead, webhookHandler.ListWebhooks))
+	mux.Handle("POST /api/boards/{id}/webhooks", authed(auth.ScopeBoardsWrite, webhookHandler.CreateWebhook))
+	mux.Handle("DELETE /api/webhooks/{id}", authed(auth.ScopeBoardsWrite, webhookHandler.DeleteWebhook))
+	mux.Handle("GET /api/webhooks/{id}/deliveries", authed(auth.ScopeBoardsRead, webhookHandler.ListDeliveries))
+	mux.Handle("GET /api/webhooks/{id}/deliveries/{deliveryID}/attempts", authed(auth.ScopeBoardsRead, webhookHandler.ListAttempts))
+	mux.Handle("POST /api/webhooks/{id}/deliveries/{deliveryID}/redeliver", authed(auth.ScopeBoardsWrite, webhookHandler.Redeliver))
+
+	// Feeds (authorized by the token in the URL, not the session cookie)
+	mux.HandleFunc("GET /api/feeds/calendar/{token}", feedHandler.Calendar)
+	mux.Handle("POST /api/feeds/calendar/token", authed(auth.ScopeAccountWrite, feedHandler.RotateUserCalendarToken))
+	mux.Handle("DELETE /api/feeds/calendar/token", authed(auth.ScopeAccountWrite, feedHandler.RevokeUserCalendarToken))
+	mux.Handle("POST /api/boards/{id}/feeds/calendar/token", authed(auth.ScopeBoardsWrite, feedHandler.RotateBoardCalendarToken))
+	mux.Handle("DELETE /api/boards/{id}/feeds/calendar/token", authed(auth.ScopeBoardsWrite, feedHandler.RevokeBoardCalendarToken))
+	mux.HandleFunc("GET /api/feeds/activity/{token}", feedHandler.Activity)
+	mux.Handle("POST /api/boards/{id}/feeds/activity/token", authed(auth.ScopeBoardsWrite, feedHandler.RotateBoardActivityToken))
+	mux.Handle("DELETE /api/boards/{id}/feeds/activity/token", authed(auth.ScopeBoardsWrite, feedHandler.RevokeBoardActivityToken))
 
 	// Apply middleware
 	var handler http.Handler = mux
+	handler = limitBody(mux, cmp.Or(cfg.MaxBodyBytes, defaultMaxBodyBytes), bodyLimits)(handler)
+	handler = csrf(cfg.AllowOrigin)(handler)
 	handler = cors(cfg.AllowOrigin)(handler)
-	handler = logging(handler)
 	handler = recovery(handler)
+	if cfg.Metrics != nil {
+		handler = instrument(cfg.Metrics, mux)(handler)
+	}
+	handler = accessLog(logger)(handler)
+	handler = traceRequests(tp, mux)(handler)
+	handler = securityHeaders(strings.HasPrefix(cfg.BaseURL, "https://"))(handler)
+	if len(cfg.TrustedProxies) > 0 {
+		handler = realIP(cfg.TrustedProxies)(handler)
+	}
+	handler = requestID(handler)
 
-	return &http.Server{Handler: handler}
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cmp.Or(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       cmp.Or(cfg.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      cmp.Or(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       cmp.Or(cfg.IdleTimeout, defaultIdleTimeout),
+	}, nil
 }
@@ -1,17 +1,41 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"trello-clone/internal/auth"
+	"trello-clone/internal/httputil"
+	"trello-clone/internal/logging"
+	"trello-clone/internal/metrics"
 	"trello-clone/internal/testutil"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// newServer builds the server under test.
+func newServer(t *testing.T, cfg Config) *http.Server {
+	t.Helper()
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	return srv
+}
+
 func TestHealthEndpoint(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := New(Config{DB: db})
+	srv := newServer(t, Config{DB: db})
 
 	r := httptest.NewRequest(http.MethodGet, "/api/health", nil)
 	w := httptest.NewRecorder()
@@ -32,7 +56,7 @@ func TestHealthEndpoint(t *testing.T) {
 
 func TestCORSHeaders(t *testing.T) {
 	db := testutil.SetupDB(t)
-	srv := New(Config{DB: db, AllowOrigin: "http://localhost:5173"})
+	srv := newServer(t, Config{DB: db, AllowOrigin: "http://localhost:5173"})
 
 	r := httptest.NewRequest(http.MethodOptions, "/api/boards", nil)
 	w := httptest.NewRecorder()
@@ -44,8 +68,12 @@ func TestCORSHeaders(t *testing.T) {
 	if acao := w.Header().Get("Access-Control-Allow-Origin"); acao != "http://localhost:5173" {
 		t.Fatalf("ACAO = %q, want http://localhost:5173", acao)
 	}
-	if acam := w.Header().Get("Access-Control-Allow-Methods"); acam == "" {
-		t.Fatal("expected Access-Control-Allow-Methods header")
+	// Every method the API routes use must be allowed cross-origin.
+	acam := w.Header().Get("Access-Control-Allow-Methods")
+	for _, m := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		if !strings.Contains(acam, m) {
+			t.Fatalf("Access-Control-Allow-Methods = %q, missing %s", acam, m)
+		}
 	}
 	if acah := w.Header().Get("Access-Control-Allow-Headers"); acah == "" {
 		t.Fatal("expected Access-Control-Allow-Headers header")
@@ -72,3 +100,343 @@ func TestRecoveryMiddleware(t *testing.T) {
 		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
 	}
 }
+
+func TestCSRFMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := csrf("http://localhost:5173")(ok)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"cross-site form post", http.MethodPost, map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"cross-site post, Origin only", http.MethodPost, map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"sandboxed frame", http.MethodPost, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"same-site, untrusted origin", http.MethodDelete, map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "http://other.localhost:5173"}, http.StatusForbidden},
+		{"frontend", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "http://localhost:5173"}, http.StatusNoContent},
+		{"frontend, Origin only", http.MethodPatch, map[string]string{"Origin": "http://localhost:5173"}, http.StatusNoContent},
+		{"same origin", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://api.test"}, http.StatusNoContent},
+		{"same origin, Origin only", http.MethodPost, map[string]string{"Origin": "http://api.test"}, http.StatusNoContent},
+		{"not a browser", http.MethodPost, nil, http.StatusNoContent},
+		{"bearer token", http.MethodPost, map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example.com", "Authorization": "Bearer fbp_x"}, http.StatusNoContent},
+		{"cross-site GET", http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example.com"}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://api.test/api/boards", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrossSiteFormPostRejected(t *testing.T) {
+	srv := newServer(t, Config{AllowOrigin: "http://localhost:5173"})
+
+	for _, path := range []string{"/api/auth/login", "/api/auth/logout", "/api/boards"} {
+		form := url.Values{"email": {"victim@example.com"}, "password": {"x"}, "name": {"pwned"}}
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://evil.example.com")
+		r.Header.Set("Sec-Fetch-Site", "cross-site")
+		r.AddCookie(&http.Cookie{Name: "session", Value: "victim-session"})
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s: status = %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+		// CORS headers are still set, so the frontend can read the error.
+		if w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:5173" {
+			t.Fatalf("%s: missing CORS headers", path)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"propagated", "edge-4f2a:1", true},
+		{"generated", "", false},
+		{"invalid characters", "id with spaces\n", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			got := w.Header().Get("X-Request-ID")
+			if got == "" || got != seen {
+				t.Fatalf("response ID %q, context ID %q", got, seen)
+			}
+			if (got == tt.header) != tt.keep {
+				t.Fatalf("ID = %q for header %q", got, tt.header)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	var seen string
+	handler := realIP([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct client", "203.0.113.9:4000", []string{"1.2.3.4"}, "203.0.113.9:4000"},
+		{"through proxy", "10.0.0.2:4000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed entries before the proxy's", "10.0.0.2:4000", []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"chain of proxies", "10.0.0.2:4000", []string{"203.0.113.9", "10.0.0.3"}, "203.0.113.9"},
+		{"no header", "10.0.0.2:4000", nil, "10.0.0.2"},
+		{"garbage", "10.0.0.2:4000", []string{"203.0.113.9, not-an-ip"}, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if seen != tt.want {
+				t.Fatalf("RemoteAddr = %q, want %q", seen, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requestID(accessLog(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.SetUserID(r.Context(), "user-1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/boards", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log = %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":        "request",
+		"method":     "POST",
+		"path":       "/api/boards",
+		"status":     float64(http.StatusCreated),
+		"bytes":      float64(5),
+		"request_id": "req-1",
+		"user_id":    "user-1",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+	if _, ok := entry["latency"]; !ok {
+		t.Error("missing latency")
+	}
+}
+
+func TestMetricsUseRoutePatterns(t *testing.T) {
+	m := metrics.New(nil)
+	srv := newServer(t, Config{Metrics: m})
+
+	for _, path := range []string{"/api/boards/1", "/api/boards/2", "/no/such/route"} {
+		srv.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	m.Handler("").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`flowboard_http_requests_total{code="401",method="GET",route="GET /api/boards/{id}"} 2`,
+		`flowboard_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(body, "/api/boards/1") {
+		t.Error("raw path used as a label")
+	}
+}
+
+func TestTracingContinuesIncomingTrace(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	var logBuf bytes.Buffer
+	logger, _ := logging.New(&logBuf, "json", "info")
+	srv := newServer(t, Config{TracerProvider: tp, Logger: logger})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/boards/42", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	srv.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /api/boards/{id}" || span.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("span = %q (%s)", span.Name(), span.SpanKind())
+	}
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("trace %s, parent %s", span.SpanContext().TraceID(), span.Parent().SpanID())
+	}
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["http.route"] != "GET /api/boards/{id}" || attrs["http.response.status_code"] != "401" {
+		t.Fatalf("attributes = %v", attrs)
+	}
+	if !strings.Contains(logBuf.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Fatalf("access log lacks trace ID: %s", logBuf.String())
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		baseURL  string
+		tls      bool
+		wantHSTS bool
+	}{
+		{"plain http", "http://localhost:8080", false, false},
+		{"TLS connection", "http://localhost:8080", true, true},
+		{"behind a TLS proxy", "https://flowboard.example.com", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, Config{BaseURL: tt.baseURL})
+			r := httptest.NewRequest(http.MethodGet, "/livez", nil)
+			if tt.tls {
+				r = httptest.NewRequest(http.MethodGet, "https://localhost:8080/livez", nil)
+			}
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, r)
+
+			for header, want := range map[string]string{
+				"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'",
+				"X-Content-Type-Options":  "nosniff",
+				"X-Frame-Options":         "DENY",
+				"Referrer-Policy":         "no-referrer",
+			} {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+			if hsts := w.Header().Get("Strict-Transport-Security"); (hsts != "") != tt.wantHSTS {
+				t.Errorf("Strict-Transport-Security = %q, want it set: %v", hsts, tt.wantHSTS)
+			}
+		})
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	read := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			httputil.InvalidBody(w, err)
+		}
+	}
+	mux.HandleFunc("POST /small", read)
+	mux.HandleFunc("POST /upload", read)
+	handler := limitBody(mux, 10, map[string]int64{"POST /upload": 100})(mux)
+
+	for _, tt := range []struct {
+		path string
+		size int
+		// hideLength sends the body without Content-Length, so the limit
+		// is hit while reading rather than checked up front.
+		hideLength bool
+		want       int
+	}{
+		{"/small", 10, false, http.StatusOK},
+		{"/small", 11, false, http.StatusRequestEntityTooLarge},
+		{"/small", 11, true, http.StatusRequestEntityTooLarge},
+		{"/upload", 100, false, http.StatusOK},
+		{"/upload", 101, true, http.StatusRequestEntityTooLarge},
+	} {
+		var body io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+		if tt.hideLength {
+			body = io.MultiReader(body)
+		}
+		r := httptest.NewRequest(http.MethodPost, tt.path, body)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s with %d bytes: status = %d, want %d (%s)", tt.path, tt.size, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+func TestOversizedJSONBodyRejected(t *testing.T) {
+	srv := newServer(t, Config{MaxBodyBytes: 64})
+	body := `{"email":"` + strings.Repeat("a", 100) + `@example.com","password":"x"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if !strings.Contains(w.Body.String(), "limit 64 bytes") {
+		t.Fatalf("body = %s", w.Body)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	srv := newServer(t, Config{})
+	if srv.ReadHeaderTimeout != defaultReadHeaderTimeout || srv.ReadTimeout != defaultReadTimeout ||
+		srv.WriteTimeout != defaultWriteTimeout || srv.IdleTimeout != defaultIdleTimeout {
+		t.Fatalf("default timeouts = %s %s %s %s", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	srv = newServer(t, Config{ReadTimeout: 5 * time.Second, WriteTimeout: 3 * time.Minute})
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != 3*time.Minute || srv.IdleTimeout != defaultIdleTimeout {
+		t.Fatalf("timeouts = %s %s %s", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+func TestNewRejectsBadOIDCProvider(t *testing.T) {
+	_, err := New(Config{OIDCProviders: []auth.OIDCProviderConfig{{Name: "google", Issuer: "https://sso.example.com", ClientID: "x"}}})
+	if err == nil || !strings.Contains(err.Error(), `"google"`) {
+		t.Fatalf("err = %v, want the provider named", err)
+	}
+}
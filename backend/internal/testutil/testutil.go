@@ -69,7 +69,7 @@ func SetupDB(t *testing.T) *sql.DB {
 
 	// Truncate all tables in FK-safe order, then re-populate schema_migrations.
 	_, _ = db.ExecContext(ctx,
-		`TRUNCATE cards, board_columns, boards, oauth_accounts, sessions, users, schema_migrations CASCADE`)
+		`TRUNCATE jobs, job_schedules, webhook_delivery_attempts, webhook_deliveries, webhooks, feed_tokens, card_activity, cards, board_columns, boards, oauth_accounts, email_changes, account_deletions, login_failures, login_challenges, recovery_codes, email_verification_tokens, password_reset_tokens, access_tokens, sessions, users, schema_migrations CASCADE`)
 	if err := database.Migrate(ctx, db); err != nil {
 		db.Close()
 		t.Fatalf("re-migrate: %v", err)
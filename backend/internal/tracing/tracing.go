@@ -0,0 +1,62 @@
+// Package tracing sets up OpenTelemetry tracing. HTTP requests get a span
+// each in the server middleware, and every SQL query gets a child span from
+// the database package's pgx tracer.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. exporter picks where spans go:
+//
+//   - "otlp": OTLP over HTTP, configured by the standard
+//     OTEL_EXPORTER_OTLP_* variables
+//   - "stdout" (or "console"): pretty-printed to stdout, for local debugging
+//   - "" or "none": nowhere; the default no-op provider stays in place
+//
+// The service is named "flowboard" unless OTEL_SERVICE_NAME says
+// otherwise. The returned function flushes buffered spans and stops the
+// provider.
+func Setup(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("trace exporter %q: use otlp, stdout or none", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter %s: %w", exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("flowboard")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
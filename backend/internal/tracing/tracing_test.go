@@ -0,0 +1,19 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	if _, err := Setup(context.Background(), "zipkin"); err == nil {
+		t.Fatal("expected error for unknown exporter")
+	}
+	shutdown, err := Setup(context.Background(), "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,251 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+	"trello-clone/internal/board"
+	"trello-clone/internal/health"
+)
+
+// Payload is the JSON body POSTed to webhook URLs.
+type Payload struct {
+	ID         string      `json:"id"`
+	Event      string      `json:"event"`
+	BoardID    string      `json:"board_id"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Card       PayloadCard `json:"card"`
+}
+
+type PayloadCard struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Column     string `json:"column"`
+	FromColumn string `json:"from_column,omitempty"`
+}
+
+func newPayload(a board.Activity) Payload {
+	return Payload{
+		ID:         a.ID,
+		Event:      a.Kind,
+		BoardID:    a.BoardID,
+		OccurredAt: a.CreatedAt,
+		Card: PayloadCard{
+			ID:         a.CardID,
+			Title:      a.CardTitle,
+			Column:     a.ColumnName,
+			FromColumn: a.FromColumnName,
+		},
+	}
+}
+
+// Sign returns the value of the X-FlowBoard-Signature header for body:
+// "sha256=" followed by the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers pending webhook deliveries from the outbox.
+type Dispatcher struct {
+	Store  *Store
+	Client *http.Client
+	// Interval between polls of the outbox.
+	Interval time.Duration
+	// MaxAttempts is the number of attempts before a delivery is marked
+	// failed. It can still be redelivered by hand afterwards.
+	MaxAttempts int
+	// BaseBackoff is the delay before the first retry; it doubles with each
+	// attempt up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	tracker health.Tracker
+}
+
+func NewDispatcher(store *Store) *Dispatcher {
+	return &Dispatcher{
+		Store:       store,
+		Client:      NewClient(),
+		Interval:    5 * time.Second,
+		MaxAttempts: 8,
+		BaseBackoff: 30 * time.Second,
+		MaxBackoff:  6 * time.Hour,
+	}
+}
+
+// ErrForbiddenAddress is returned when a webhook URL resolves to an address
+// on the server's own network.
+var ErrForbiddenAddress = errors.New("webhook address not allowed")
+
+// NewClient returns the HTTP client used for deliveries. Webhook URLs are
+// user-supplied, so it refuses to connect to loopback, private, link-local
+// and unspecified addresses. The check runs on the resolved address, so a
+// hostname pointing inward is caught too. Redirects aren't followed: the
+// 3xx response is the delivery's result.
+func NewClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialled in place of the target, skipping the check.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !PublicAddr(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+	return nil
+}
+
+// PublicAddr reports whether ip may receive webhook deliveries.
+func PublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// Status reports whether Run is running, when it last polled the outbox
+// and the last error it ran into.
+func (d *Dispatcher) Status() health.WorkerStatus {
+	return d.tracker.Status()
+}
+
+// deliveryLease is how long a claimed delivery is hidden from other workers.
+// It must exceed the client timeout.
+const deliveryLease = time.Minute
+
+// Run polls the outbox until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.tracker.Start(1)
+	defer d.tracker.Stop()
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		_, err := d.DeliverDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "webhook dispatcher", "error", err)
+		} else {
+			err = nil
+		}
+		d.tracker.Poll(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts every delivery that is currently due and returns how
+// many were attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		batch, err := d.Store.ClaimDue(ctx, 20, deliveryLease)
+		if err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+		for _, del := range batch {
+			if err := d.attempt(ctx, del); err != nil {
+				return total, err
+			}
+			total++
+		}
+	}
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, del Delivery) error {
+	wh, err := d.Store.WebhookByID(ctx, del.WebhookID)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	statusCode, sendErr := d.send(ctx, wh, del)
+	duration := time.Since(start)
+
+	var code *int
+	if statusCode != 0 {
+		code = &statusCode
+	}
+	var errMsg string
+	if sendErr != nil {
+		errMsg = sendErr.Error()
+	}
+
+	attempts := del.Attempts + 1
+	status, next := StatusSucceeded, time.Now()
+	if sendErr != nil {
+		status = StatusPending
+		next = time.Now().Add(d.backoff(attempts))
+		if attempts >= d.MaxAttempts {
+			status = StatusFailed
+		}
+	}
+	return d.Store.RecordAttempt(ctx, del.ID, code, errMsg, duration, status, next)
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseBackoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, d.MaxBackoff)
+}
+
+func (d *Dispatcher) send(ctx context.Context, wh *Webhook, del Delivery) (int, error) {
+	body := []byte(del.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FlowBoard-Webhooks/1")
+	req.Header.Set("X-FlowBoard-Event", del.Event)
+	req.Header.Set("X-FlowBoard-Delivery", del.ID)
+	req.Header.Set("X-FlowBoard-Signature", Sign(wh.Secret, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
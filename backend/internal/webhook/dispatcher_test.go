@@ -0,0 +1,233 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"trello-clone/internal/auth"
+	"trello-clone/internal/board"
+	"trello-clone/internal/testutil"
+)
+
+func TestSign(t *testing.T) {
+	// Reference value from: printf 'hello' | openssl dgst -sha256 -hmac secret
+	got := Sign("secret", []byte("hello"))
+	want := "sha256=88aab3ede8d3adf94d26ab90d3bafd4a2083070c3bcce9c014ee04a443847c0b"
+	if got != want {
+		t.Fatalf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if got := PublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("PublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	var hit bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer ts.Close()
+
+	_, err := NewClient().Get(ts.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("err = %v, want ErrForbiddenAddress", err)
+	}
+	if hit {
+		t.Fatal("request reached the loopback server")
+	}
+}
+
+func TestClientDoesNotFollowRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	defer ts.Close()
+
+	// Only the redirect policy is under test, so use the test server's
+	// transport to reach it on loopback.
+	c := NewClient()
+	c.Transport = ts.Client().Transport
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := d.backoff(i + 1); got != w {
+			t.Fatalf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+// receiver records webhook requests and answers with status.
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+// setupBoard creates a user, a board and a webhook pointing at url, and
+// returns a board store that enqueues deliveries plus the board's first
+// column ID.
+func setupBoard(t *testing.T, db *sql.DB, url string, events []string) (*board.Store, *Webhook, string) {
+	t.Helper()
+	ctx := context.Background()
+	authStore := &auth.Store{DB: db}
+	u, err := authStore.CreateUser(ctx, "hook@example.com", "hash", "Hook")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	store := &Store{DB: db}
+	boards := &board.Store{DB: db, OnActivity: store.Enqueue}
+	b, _ := boards.CreateBoard(ctx, u.ID, "Hooked")
+	full, _ := boards.GetBoard(ctx, b.ID, u.ID)
+
+	wh, err := store.CreateWebhook(ctx, b.ID, url, "s3cret", events)
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	return boards, wh, full.Columns[0].ID
+}
+
+func TestDeliverSigned(t *testing.T) {
+	db := testutil.SetupDB(t)
+	rc := &receiver{status: http.StatusOK}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	boards, wh, colID := setupBoard(t, db, ts.URL, nil)
+	ctx := context.Background()
+	card, _ := boards.CreateCard(ctx, colID, "Hello hooks", "")
+
+	d := NewDispatcher(&Store{DB: db})
+	// The test receiver is on loopback, which the default client refuses.
+	d.Client = ts.Client()
+	n, err := d.DeliverDue(ctx)
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if n != 1 || len(rc.requests) != 1 {
+		t.Fatalf("attempted = %d, received = %d, want 1", n, len(rc.requests))
+	}
+
+	req, body := rc.requests[0], rc.bodies[0]
+	if got := req.Header.Get("X-FlowBoard-Signature"); got != Sign("s3cret", body) {
+		t.Fatalf("signature = %q, want %q", got, Sign("s3cret", body))
+	}
+	if got := req.Header.Get("X-FlowBoard-Event"); got != board.ActivityCreated {
+		t.Fatalf("event header = %q, want %q", got, board.ActivityCreated)
+	}
+	var p Payload
+	json.Unmarshal(body, &p)
+	if p.Card.ID != card.ID || p.Card.Title != "Hello hooks" {
+		t.Fatalf("payload = %+v", p)
+	}
+
+	deliveries, _ := (&Store{DB: db}).ListDeliveries(ctx, wh.ID, 10)
+	if len(deliveries) != 1 || deliveries[0].Status != StatusSucceeded {
+		t.Fatalf("deliveries = %+v, want one succeeded", deliveries)
+	}
+}
+
+func TestDeliverRetriesAndRedeliver(t *testing.T) {
+	db := testutil.SetupDB(t)
+	rc := &receiver{status: http.StatusInternalServerError}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	boards, wh, colID := setupBoard(t, db, ts.URL, nil)
+	ctx := context.Background()
+	boards.CreateCard(ctx, colID, "Flaky", "")
+
+	store := &Store{DB: db}
+	d := NewDispatcher(store)
+	d.Client = ts.Client()
+	d.MaxAttempts = 2
+	d.BaseBackoff = 0
+
+	// Two failing attempts exhaust the retry budget.
+	d.DeliverDue(ctx)
+	d.DeliverDue(ctx)
+
+	deliveries, _ := store.ListDeliveries(ctx, wh.ID, 10)
+	if len(deliveries) != 1 {
+		t.Fatalf("deliveries = %d, want 1", len(deliveries))
+	}
+	del := deliveries[0]
+	if del.Status != StatusFailed || del.Attempts != 2 {
+		t.Fatalf("delivery = %+v, want failed after 2 attempts", del)
+	}
+	if del.LastStatusCode == nil || *del.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("last_status_code = %v, want 500", del.LastStatusCode)
+	}
+	attempts, _ := store.ListAttempts(ctx, wh.ID, del.ID)
+	if len(attempts) != 2 {
+		t.Fatalf("attempts logged = %d, want 2", len(attempts))
+	}
+
+	// A manual redelivery succeeds once the receiver recovers.
+	rc.status = http.StatusNoContent
+	if _, err := store.Redeliver(ctx, wh.ID, del.ID); err != nil {
+		t.Fatalf("redeliver: %v", err)
+	}
+	d.DeliverDue(ctx)
+	deliveries, _ = store.ListDeliveries(ctx, wh.ID, 10)
+	if deliveries[0].Status != StatusSucceeded {
+		t.Fatalf("status = %s, want succeeded", deliveries[0].Status)
+	}
+}
+
+func TestEnqueueEventFilter(t *testing.T) {
+	db := testutil.SetupDB(t)
+	boards, wh, colID := setupBoard(t, db, "http://127.0.0.1:1/", []string{board.ActivityMoved})
+	ctx := context.Background()
+
+	boards.CreateCard(ctx, colID, "Not delivered", "")
+
+	deliveries, _ := (&Store{DB: db}).ListDeliveries(ctx, wh.ID, 10)
+	if len(deliveries) != 0 {
+		t.Fatalf("deliveries = %d, want 0 for filtered event", len(deliveries))
+	}
+}
@@ -0,0 +1,163 @@
+package webhook
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"trello-clone/internal/auth"
+	"trello-clone/internal/board"
+	"trello-clone/internal/httputil"
+)
+
+type Handler struct {
+	Store  *Store
+	Boards *board.Store
+}
+
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	boardID := r.PathValue("id")
+
+	if _, err := h.Boards.GetBoard(r.Context(), boardID, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "board not found")
+		return
+	}
+
+	hooks, err := h.Store.ListWebhooks(r.Context(), boardID)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, hooks)
+}
+
+// CreateWebhook subscribes a URL to the board's events. If no secret is
+// given one is generated; the secret is returned only in this response.
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	boardID := r.PathValue("id")
+
+	if _, err := h.Boards.GetBoard(r.Context(), boardID, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "board not found")
+		return
+	}
+
+	var req struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	if err := httputil.Decode(r, &req); err != nil {
+		httputil.InvalidBody(w, err)
+		return
+	}
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		httputil.Error(w, http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+	// Hostnames are checked when delivering, after they're resolved; this
+	// just turns away the obvious cases early.
+	if ip, err := netip.ParseAddr(target.Hostname()); (err == nil && !PublicAddr(ip)) || strings.EqualFold(target.Hostname(), "localhost") {
+		httputil.Error(w, http.StatusBadRequest, "url must not point at a private or loopback address")
+		return
+	}
+	for _, e := range req.Events {
+		if !slices.Contains(Events, e) {
+			httputil.Error(w, http.StatusBadRequest, "unknown event "+e)
+			return
+		}
+	}
+	if req.Secret == "" {
+		secret, err := auth.GenerateToken()
+		if err != nil {
+			httputil.Error(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		req.Secret = secret
+	}
+
+	wh, err := h.Store.CreateWebhook(r.Context(), boardID, req.URL, req.Secret, req.Events)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to create webhook")
+		return
+	}
+	httputil.JSON(w, http.StatusCreated, struct {
+		*Webhook
+		Secret string `json:"secret"`
+	}{wh, wh.Secret})
+}
+
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if err := h.Store.WebhookOwner(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+
+	if err := h.Store.DeleteWebhook(r.Context(), id); err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Deliveries
+
+// deliveryLogSize is the number of most recent deliveries listed.
+const deliveryLogSize = 100
+
+func (h *Handler) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if err := h.Store.WebhookOwner(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+
+	deliveries, err := h.Store.ListDeliveries(r.Context(), id, deliveryLogSize)
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to list deliveries")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, deliveries)
+}
+
+func (h *Handler) ListAttempts(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if err := h.Store.WebhookOwner(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+
+	attempts, err := h.Store.ListAttempts(r.Context(), id, r.PathValue("deliveryID"))
+	if err != nil {
+		httputil.Error(w, http.StatusInternalServerError, "failed to list attempts")
+		return
+	}
+	httputil.JSON(w, http.StatusOK, attempts)
+}
+
+func (h *Handler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	u := auth.UserFromContext(r.Context())
+	id := r.PathValue("id")
+
+	if err := h.Store.WebhookOwner(r.Context(), id, u.ID); err != nil {
+		httputil.Error(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+
+	d, err := h.Store.Redeliver(r.Context(), id, r.PathValue("deliveryID"))
+	if err != nil {
+		httputil.Error(w, http.StatusNotFound, "delivery not found")
+		return
+	}
+	httputil.JSON(w, http.StatusAccepted, d)
+}
@@ -0,0 +1,95 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"trello-clone/internal/server"
+	"trello-clone/internal/testutil"
+)
+
+// newServer builds the server under test.
+func newServer(t *testing.T, cfg server.Config) *http.Server {
+	t.Helper()
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	return srv
+}
+
+func doRequest(t *testing.T, srv *http.Server, method, path string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCreateWebhookHandler(t *testing.T) {
+	db := testutil.SetupDB(t)
+	srv := newServer(t, server.Config{DB: db})
+
+	sw := doRequest(t, srv, http.MethodPost, "/api/auth/signup", `{"email":"wh@example.com","password":"password123"}`, nil)
+	var cookie *http.Cookie
+	for _, c := range sw.Result().Cookies() {
+		if c.Name == "session" {
+			cookie = c
+		}
+	}
+
+	bw := doRequest(t, srv, http.MethodPost, "/api/boards", `{"name":"Hooks"}`, cookie)
+	var board map[string]any
+	json.Unmarshal(bw.Body.Bytes(), &board)
+	path := "/api/boards/" + board["id"].(string) + "/webhooks"
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"bad url", `{"url":"ftp://example.com"}`, http.StatusBadRequest},
+		{"loopback url", `{"url":"http://127.0.0.1:8080/hook"}`, http.StatusBadRequest},
+		{"localhost url", `{"url":"http://localhost/hook"}`, http.StatusBadRequest},
+		{"metadata url", `{"url":"http://169.254.169.254/latest/meta-data/"}`, http.StatusBadRequest},
+		{"unknown event", `{"url":"https://example.com/hook","events":["board.exploded"]}`, http.StatusBadRequest},
+		{"valid", `{"url":"https://example.com/hook","events":["card.moved"]}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, srv, http.MethodPost, path, tt.body, cookie)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d; body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusCreated {
+				var created map[string]any
+				json.Unmarshal(w.Body.Bytes(), &created)
+				if s, _ := created["secret"].(string); s == "" {
+					t.Fatal("expected generated secret in create response")
+				}
+			}
+		})
+	}
+
+	lw := doRequest(t, srv, http.MethodGet, path, "", cookie)
+	var hooks []map[string]any
+	json.Unmarshal(lw.Body.Bytes(), &hooks)
+	if len(hooks) != 1 {
+		t.Fatalf("webhooks = %d, want 1", len(hooks))
+	}
+	if _, ok := hooks[0]["secret"]; ok {
+		t.Fatal("secret should not be listed")
+	}
+}
@@ -0,0 +1,281 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+	"trello-clone/internal/board"
+)
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Events lists the event types a webhook can subscribe to.
+var Events = []string{board.ActivityCreated, board.ActivityUpdated, board.ActivityMoved}
+
+// Webhook is a per-board subscription. Events is a space-separated filter;
+// empty means every event.
+type Webhook struct {
+	ID        string    `json:"id"`
+	BoardID   string    `json:"board_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    string    `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Delivery struct {
+	ID             string     `json:"id"`
+	WebhookID      string     `json:"webhook_id"`
+	Event          string     `json:"event"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastStatusCode *int       `json:"last_status_code"`
+	LastError      string     `json:"last_error"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type Attempt struct {
+	ID         string    `json:"id"`
+	StatusCode *int      `json:"status_code"`
+	Error      string    `json:"error"`
+	DurationMS int       `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Store struct {
+	DB *sql.DB
+}
+
+func (s *Store) CreateWebhook(ctx context.Context, boardID, url, secret string, events []string) (*Webhook, error) {
+	wh := &Webhook{}
+	err := s.DB.QueryRowContext(ctx,
+		`INSERT INTO webhooks (board_id, url, secret, events) VALUES ($1, $2, $3, $4)
+		 RETURNING id, board_id, url, secret, events, created_at`,
+		boardID, url, secret, strings.Join(events, " "),
+	).Scan(&wh.ID, &wh.BoardID, &wh.URL, &wh.Secret, &wh.Events, &wh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func (s *Store) ListWebhooks(ctx context.Context, boardID string) ([]Webhook, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, board_id, url, secret, events, created_at FROM webhooks WHERE board_id=$1 ORDER BY created_at`, boardID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var wh Webhook
+		if err := rows.Scan(&wh.ID, &wh.BoardID, &wh.URL, &wh.Secret, &wh.Events, &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, wh)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *Store) DeleteWebhook(ctx context.Context, id string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id=$1`, id)
+	return err
+}
+
+// WebhookOwner checks the webhook belongs to one of the user's boards.
+func (s *Store) WebhookOwner(ctx context.Context, id, userID string) error {
+	var exists bool
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT EXISTS(
+			SELECT 1 FROM webhooks w
+			JOIN boards b ON b.id = w.board_id
+			WHERE w.id=$1 AND b.user_id=$2
+		)`,
+		id, userID,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Outbox
+
+// Enqueue writes a pending delivery for every webhook on the activity's
+// board that subscribes to its event. It runs inside the transaction that
+// recorded the activity, so an event is queued if and only if the change
+// commits. It matches board.Store.OnActivity.
+func (s *Store) Enqueue(ctx context.Context, tx *sql.Tx, a board.Activity) error {
+	payload, err := json.Marshal(newPayload(a))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		 SELECT id, $2, $3 FROM webhooks
+		 WHERE board_id=$1 AND (events = '' OR $2 = ANY(string_to_array(events, ' ')))`,
+		a.BoardID, a.Kind, string(payload),
+	)
+	return err
+}
+
+// ClaimDue leases up to limit pending deliveries whose next attempt is due
+// by pushing their next_attempt_at forward by lease. Leasing instead of
+// holding row locks keeps transactions short while requests are in flight,
+// and a crashed worker's deliveries become due again once the lease ends.
+func (s *Store) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]Delivery, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`UPDATE webhook_deliveries SET next_attempt_at = now() + $2::bigint * interval '1 millisecond'
+		 WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status='pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, webhook_id, event, payload, status, attempts, next_attempt_at, last_status_code, last_error, delivered_at, created_at`,
+		limit, lease.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *Store) WebhookByID(ctx context.Context, id string) (*Webhook, error) {
+	wh := &Webhook{}
+	err := s.DB.QueryRowContext(ctx,
+		`SELECT id, board_id, url, secret, events, created_at FROM webhooks WHERE id=$1`, id,
+	).Scan(&wh.ID, &wh.BoardID, &wh.URL, &wh.Secret, &wh.Events, &wh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+// RecordAttempt logs one delivery attempt and moves the delivery to its
+// next state: succeeded, failed (no retries left) or pending at nextAttempt.
+func (s *Store) RecordAttempt(ctx context.Context, deliveryID string, statusCode *int, errMsg string, duration time.Duration, status string, nextAttempt time.Time) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO webhook_delivery_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, $2, $3, $4)`,
+		deliveryID, statusCode, errMsg, duration.Milliseconds(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET
+			status = $2,
+			attempts = attempts + 1,
+			next_attempt_at = $3,
+			last_status_code = $4,
+			last_error = $5,
+			delivered_at = CASE WHEN $2 = 'succeeded' THEN now() ELSE delivered_at END
+		 WHERE id=$1`,
+		deliveryID, status, nextAttempt, statusCode, errMsg,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ListDeliveries(ctx context.Context, webhookID string, limit int) ([]Delivery, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, last_status_code, last_error, delivered_at, created_at
+		 FROM webhook_deliveries WHERE webhook_id=$1 ORDER BY created_at DESC LIMIT $2`,
+		webhookID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *Store) ListAttempts(ctx context.Context, webhookID, deliveryID string) ([]Attempt, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		`SELECT a.id, a.status_code, a.error, a.duration_ms, a.created_at
+		 FROM webhook_delivery_attempts a
+		 JOIN webhook_deliveries d ON d.id = a.delivery_id
+		 WHERE a.delivery_id=$1 AND d.webhook_id=$2
+		 ORDER BY a.created_at`, deliveryID, webhookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.ID, &a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// Redeliver makes a delivery of the given webhook due immediately with a
+// fresh retry budget. Earlier attempts stay in the log.
+func (s *Store) Redeliver(ctx context.Context, webhookID, deliveryID string) (*Delivery, error) {
+	row := s.DB.QueryRowContext(ctx,
+		`UPDATE webhook_deliveries SET status='pending', attempts=0, next_attempt_at=now()
+		 WHERE id=$1 AND webhook_id=$2
+		 RETURNING id, webhook_id, event, payload, status, attempts, next_attempt_at, last_status_code, last_error, delivered_at, created_at`,
+		deliveryID, webhookID,
+	)
+	return scanDelivery(row)
+}
+
+func scanDelivery(row interface{ Scan(...any) error }) (*Delivery, error) {
+	d := &Delivery{}
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastStatusCode, &d.LastError, &d.DeliveredAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}